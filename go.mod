@@ -2,11 +2,14 @@ module gitlab.com/metakeule/scaffold
 
 go 1.18
 
-require gitlab.com/metakeule/config v1.18.9
+require (
+	github.com/pelletier/go-toml v1.8.1
+	gitlab.com/metakeule/config v1.18.9
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/emersion/go-appdir v1.1.2 // indirect
-	github.com/pelletier/go-toml v1.8.1 // indirect
 	gitlab.com/metakeule/fmtdate v1.2.0 // indirect
 	golang.org/x/sys v0.0.0-20201211090839-8ad439b19e0f // indirect
 )
@@ -0,0 +1,326 @@
+package scaffold
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Attributes are the attributes of a context. They follow the name on the opening line
+// of the context, separated by spaces, e.g.
+//
+//	>>>run.sh mode=0755 ifmissing
+//
+// Attributes either have a value (key=value) or are flags (key).
+type Attributes struct {
+
+	// Mode are the permissions of the file or directory (mode=0755), 0 is the default mode.
+	// The umask is not applied.
+	Mode os.FileMode
+
+	// IfMissing creates the file only if it does not exist yet (ifmissing)
+	IfMissing bool
+
+	// Append appends the content to the file if it already exists (append)
+	Append bool
+
+	// Insert inserts the content into the existing file before the line with the
+	// marker comment "scaffold:insert [Insert]" (insert=routes)
+	Insert string
+
+	// SkipEmpty skips the file if its content is empty or only whitespace (skipempty)
+	SkipEmpty bool
+
+	// Verbatim copies the content of the context to the file as it is, without
+	// processing it by text/template (verbatim)
+	Verbatim bool
+
+	// Binary decodes the content of the context from base64 (binary)
+	Binary bool
+
+	// Asset copies the given file inside the AssetDir of the Generator to the file,
+	// the context must be empty (asset=img/logo.png)
+	Asset string
+
+	// EOL converts the line endings of the content to "lf" (\n) or "crlf" (\r\n) (eol=crlf).
+	// Without it, the line endings are kept as they are in the template.
+	EOL string
+
+	// NoEOL removes the \n after the last line of the content, or the \r\n if EOL is "crlf" (noeol).
+	// A \r that precedes the \n otherwise is kept, since it may be part of the content.
+	NoEOL bool
+
+	// Link makes the file a symlink to the given target (link=../shared/config.json).
+	// Relative targets are relative to the directory of the symlink.
+	Link string
+
+	// Key identifies the content of append and insert contexts (key=UserRoute). If the key is found
+	// at the marker (or at the end of the file for append), the content is not added again.
+	// Without a key, the content itself is searched for.
+	Key string
+}
+
+// attribute describes how an attribute is parsed and formatted
+type attribute struct {
+
+	// flag is true for attributes without a value
+	flag bool
+
+	// dir is true for attributes that are allowed for dir contexts
+	dir bool
+
+	// parse sets the attribute, value is empty for flags
+	parse func(a *Attributes, value string) error
+
+	// format returns the value of the attribute, or false if it is not set (the value of flags is ignored)
+	format func(a Attributes) (value string, isSet bool)
+}
+
+// attributes are the known attributes by name
+var attributes = map[string]attribute{
+	"mode": {
+		dir: true,
+		parse: func(a *Attributes, value string) error {
+			m, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || m == 0 || m > 0777 {
+				return fmt.Errorf("invalid mode %#v", value)
+			}
+			a.Mode = os.FileMode(m)
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return fmt.Sprintf("%04o", a.Mode), a.Mode != 0
+		},
+	},
+	"ifmissing": {
+		flag: true,
+		parse: func(a *Attributes, value string) error {
+			a.IfMissing = true
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return "", a.IfMissing
+		},
+	},
+	"append": {
+		flag: true,
+		parse: func(a *Attributes, value string) error {
+			a.Append = true
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return "", a.Append
+		},
+	},
+	"insert": {
+		parse: func(a *Attributes, value string) error {
+			if value == "" {
+				return fmt.Errorf("missing name of insert marker")
+			}
+			a.Insert = value
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return a.Insert, a.Insert != ""
+		},
+	},
+	"skipempty": {
+		flag: true,
+		parse: func(a *Attributes, value string) error {
+			a.SkipEmpty = true
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return "", a.SkipEmpty
+		},
+	},
+	"verbatim": {
+		flag: true,
+		parse: func(a *Attributes, value string) error {
+			a.Verbatim = true
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return "", a.Verbatim
+		},
+	},
+	"binary": {
+		flag: true,
+		parse: func(a *Attributes, value string) error {
+			a.Binary = true
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return "", a.Binary
+		},
+	},
+	"asset": {
+		parse: func(a *Attributes, value string) error {
+			if value == "" {
+				return fmt.Errorf("missing file of asset")
+			}
+			a.Asset = value
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return a.Asset, a.Asset != ""
+		},
+	},
+	"eol": {
+		parse: func(a *Attributes, value string) error {
+			if value != "lf" && value != "crlf" {
+				return fmt.Errorf("invalid eol %#v (must be lf or crlf)", value)
+			}
+			a.EOL = value
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return a.EOL, a.EOL != ""
+		},
+	},
+	"noeol": {
+		flag: true,
+		parse: func(a *Attributes, value string) error {
+			a.NoEOL = true
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return "", a.NoEOL
+		},
+	},
+	"link": {
+		parse: func(a *Attributes, value string) error {
+			if value == "" {
+				return fmt.Errorf("missing target of link")
+			}
+			a.Link = value
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return a.Link, a.Link != ""
+		},
+	},
+	"key": {
+		parse: func(a *Attributes, value string) error {
+			if value == "" {
+				return fmt.Errorf("missing value of key")
+			}
+			a.Key = value
+			return nil
+		},
+		format: func(a Attributes) (string, bool) {
+			return a.Key, a.Key != ""
+		},
+	},
+}
+
+// attributeOrder is the order in which the attributes are formatted
+var attributeOrder = []string{"mode", "ifmissing", "skipempty", "append", "insert", "key", "verbatim", "binary", "asset", "eol", "noeol", "link"}
+
+// requires are the attributes of which one must be given, by attribute
+var requires = map[string][]string{
+	"key": {"append", "insert"},
+}
+
+// exclusive are the attributes that can't be combined, by attribute
+var exclusive = map[string][]string{
+	"ifmissing": {"append", "insert"},
+	"append":    {"insert"},
+	"verbatim":  {"binary", "asset", "link"},
+	"binary":    {"asset", "link", "insert", "key", "eol", "noeol"},
+	"asset":     {"link", "insert", "key", "eol", "noeol"},
+	"eol":       {"link"},
+	"noeol":     {"link"},
+	"link":      {"mode", "skipempty", "append", "insert"},
+}
+
+func (a Attributes) String() string {
+	var attrs []string
+	for _, name := range attributeOrder {
+		attr := attributes[name]
+		val, isSet := attr.format(a)
+		switch {
+		case !isSet:
+		case attr.flag:
+			attrs = append(attrs, name)
+		default:
+			attrs = append(attrs, name+"="+val)
+		}
+	}
+	return strings.Join(attrs, " ")
+}
+
+// attributeRegexp matches an attribute with a value, e.g. mode=0755
+var attributeRegexp = regexp.MustCompile(`^([a-z]+)=(\S*)$`)
+
+// ParseAttributes parses the name of a context on an opening line, followed by its attributes.
+// Trailing words of the form key=value and the names of flags are attributes,
+// the rest is the name. Unknown attributes of the form key=value are an error.
+// If there is an error, the name without the attributes is returned nevertheless.
+func ParseAttributes(line string) (name string, attrs Attributes, err error) {
+	name = strings.TrimSpace(line)
+	found := map[string]bool{}
+
+	for {
+		idx := strings.LastIndexAny(name, " \t")
+		if idx < 0 {
+			break
+		}
+
+		key, value := name[idx+1:], ""
+		m := attributeRegexp.FindStringSubmatch(key)
+		if m != nil {
+			key, value = m[1], m[2]
+		} else if attr, known := attributes[key]; !known || !attr.flag {
+			break
+		}
+		name = strings.TrimSpace(name[:idx])
+
+		if err != nil {
+			continue
+		}
+
+		attr, known := attributes[key]
+		switch {
+		case !known || (attr.flag && m != nil):
+			err = fmt.Errorf("unknown attribute %#v", key)
+		case found[key]:
+			err = fmt.Errorf("duplicate attribute %#v", key)
+		default:
+			found[key] = true
+			err = attr.parse(&attrs, value)
+		}
+	}
+
+	for _, key := range attributeOrder {
+		if err != nil || !found[key] {
+			continue
+		}
+		if !attributes[key].dir && strings.HasSuffix(name, "/") {
+			err = fmt.Errorf("attribute %#v is not allowed for dirs", key)
+		}
+		if req := requires[key]; len(req) > 0 && err == nil {
+			var has bool
+			var names []string
+			for _, other := range req {
+				has = has || found[other]
+				names = append(names, strconv.Quote(other))
+			}
+			if !has {
+				err = fmt.Errorf("attribute %#v requires %s", key, strings.Join(names, " or "))
+			}
+		}
+		for _, other := range exclusive[key] {
+			if err == nil && found[other] {
+				err = fmt.Errorf("can't combine attributes %#v and %#v", key, other)
+			}
+		}
+	}
+
+	if err != nil {
+		return name, Attributes{}, err
+	}
+	return name, attrs, nil
+}
@@ -0,0 +1,322 @@
+package scaffold
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pendingFile is a rendered file that is written when the generation is committed
+type pendingFile struct {
+	path string
+
+	// generated is the generated content (recorded for ConflictMerge)
+	generated []byte
+
+	// content is the content that is written
+	content []byte
+
+	// action is the action chosen by the ConflictPolicy
+	action string
+
+	// backup is the name of the backup file for ConflictBackup (see reserveBackup)
+	backup string
+
+	// attrs are the attributes of the file context
+	attrs Attributes
+
+	// dirModes are the permissions given by the mode attributes of the surrounding directories
+	dirModes map[string]os.FileMode
+
+	// pos is the position of the line that opened the file context
+	pos Position
+}
+
+// prepareFile prepares the writing of the given file without touching the file system:
+// the BeforeWrite hook is called and if the file already exists, the attributes and g.OnConflict
+// decide what happens. Files with blank content are skipped, if the context or the Generator says so.
+// Append and insert contexts are applied to the content of the file after
+// the already prepared files have been written.
+func (g *Generator) prepareFile(file string, generated []byte, attrs Attributes, pos Position, prepared []*pendingFile) (f *pendingFile, err error) {
+	if g.Hooks.BeforeWrite != nil {
+		generated, err = g.Hooks.BeforeWrite(file, generated)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dir := filepath.Dir(file)
+	if s, err := os.Stat(dir); err == nil && !s.IsDir() {
+		return nil, fmt.Errorf("not a directory: %#v", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var action string
+	var content []byte
+	_, statErr := os.Stat(file)
+	switch {
+	case (attrs.SkipEmpty || g.SkipEmpty) && len(bytes.TrimSpace(generated)) == 0:
+		action = actionSkipped
+	case attrs.Append || attrs.Insert != "":
+		action, content, err = g.inject(file, generated, attrs, prepared)
+	case statErr == nil && attrs.IfMissing:
+		action = actionSkipped
+	default:
+		action, content, err = g.resolveConflict(file, generated, pos)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if g.plan != nil {
+		if err := g.planFile(file, action, content, prepared); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pendingFile{path: file, generated: generated, content: content, action: action, attrs: attrs, pos: pos}, nil
+}
+
+// commit writes the prepared files if g.DryRun is false.
+// Needed directories are created on the fly and each file name is written to g.Log
+// if g.Log is not nil, followed by the action chosen by g.OnConflict for existing files.
+// If anything fails, all changes of the file system are rolled back, so that either
+// all files are written or none.
+func (g *Generator) commit(files []*pendingFile) (err error) {
+	j := &journal{originals: map[string]*original{}, backups: map[string]string{}}
+	defer func() {
+		if err != nil {
+			if rerr := j.rollback(); rerr != nil {
+				err = fmt.Errorf("%s\n%s", err, rerr)
+			}
+		}
+	}()
+
+	for _, f := range files {
+		if f.action == actionBackup {
+			j.reserveBackup(f)
+		}
+
+		if g.Log != nil {
+			switch f.action {
+			case "":
+				g.Log.Write([]byte(f.path + "\n"))
+			case actionBackup:
+				g.Log.Write([]byte(f.path + " (" + f.action + ": " + f.backup + ")\n"))
+			default:
+				g.Log.Write([]byte(f.path + " (" + f.action + ")\n"))
+			}
+		}
+
+		if g.DryRun {
+			continue
+		}
+
+		if err = g.commitFile(j, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Generator) commitFile(j *journal, f *pendingFile) error {
+	if f.action == actionSkipped {
+		return nil
+	}
+
+	if err := j.mkdirAll(filepath.Dir(f.path), g.dirMode(), f.dirModes); err != nil {
+		return err
+	}
+
+	if f.attrs.Link != "" {
+		if f.action == actionUnchanged {
+			return nil
+		}
+		if err := j.symlink(f.path, f.attrs.Link); err != nil {
+			return err
+		}
+		if g.Hooks.AfterWrite != nil {
+			return g.Hooks.AfterWrite(f.path)
+		}
+		return nil
+	}
+
+	if f.backup != "" {
+		if err := g.backup(j, f); err != nil {
+			return err
+		}
+	}
+
+	// the content of append and insert contexts is not the content of the whole file
+	if g.OnConflict == ConflictMerge && !f.attrs.Append && f.attrs.Insert == "" {
+		if err := g.saveState(j, f); err != nil {
+			return err
+		}
+	}
+
+	if f.action == actionUnchanged {
+		return nil
+	}
+
+	if mode := f.attrs.Mode; mode != 0 {
+		if err := j.writeFile(f.path, f.content, mode); err != nil {
+			return err
+		}
+		// the mode is set explicitly, regardless of the umask and of the mode of an existing file
+		if err := os.Chmod(f.path, mode); err != nil {
+			return err
+		}
+	} else if err := j.writeFile(f.path, f.content, g.fileMode()); err != nil {
+		return err
+	}
+
+	if g.Hooks.AfterWrite != nil {
+		return g.Hooks.AfterWrite(f.path)
+	}
+	return nil
+}
+
+// original is the state of a file before it has been changed
+type original struct {
+	existed bool
+	content []byte
+	mode    os.FileMode
+
+	// link is the target if the file was a symlink
+	link string
+}
+
+// journal records the changes of the file system, so that they can be rolled back
+type journal struct {
+
+	// dirs are the created directories in the order of their creation
+	dirs []string
+
+	// files are the changed files in the order of their first change
+	files     []string
+	originals map[string]*original
+
+	// backups maps the files that are backed up by the run to the names of their backups
+	backups map[string]string
+}
+
+// mkdirAll creates the directory and all missing parents with the given mode.
+// Directories that are part of modes are created with the permissions given there, regardless of the umask.
+func (j *journal) mkdirAll(dir string, mode os.FileMode, modes map[string]os.FileMode) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		_, err := os.Stat(d)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], mode); err != nil {
+			return err
+		}
+		j.dirs = append(j.dirs, missing[i])
+		if m, has := modes[missing[i]]; has {
+			if err := os.Chmod(missing[i], m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// record records the original state of the file, before it is changed for the first time
+func (j *journal) record(file string) error {
+	if _, has := j.originals[file]; has {
+		return nil
+	}
+
+	o := &original{}
+	info, err := os.Lstat(file)
+	switch {
+	case err == nil && info.Mode()&os.ModeSymlink != 0:
+		o.existed = true
+		o.link, err = os.Readlink(file)
+		if err != nil {
+			return err
+		}
+	case err == nil:
+		o.existed, o.mode = true, info.Mode().Perm()
+		o.content, err = ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	j.originals[file] = o
+	j.files = append(j.files, file)
+	return nil
+}
+
+// writeFile writes the file after recording its original state
+func (j *journal) writeFile(file string, content []byte, mode os.FileMode) error {
+	if err := j.record(file); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, mode)
+}
+
+// symlink replaces the file by a symlink to target after recording its original state
+func (j *journal) symlink(file, target string) error {
+	if err := j.record(file); err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, file)
+}
+
+// rollback restores the original state of the changed files and removes the created files and directories
+func (j *journal) rollback() error {
+	var errs []string
+
+	for i := len(j.files) - 1; i >= 0; i-- {
+		file := j.files[i]
+		o := j.originals[file]
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		switch {
+		case err != nil || !o.existed:
+		case o.link != "":
+			err = os.Symlink(o.link, file)
+		default:
+			if err = ioutil.WriteFile(file, o.content, o.mode); err == nil {
+				err = os.Chmod(file, o.mode)
+			}
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for i := len(j.dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(j.dirs[i]); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("rollback failed:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package scaffold
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ConflictPolicy defines what happens if a file that should be written already exists.
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing file (default)
+	ConflictOverwrite ConflictPolicy = iota
+
+	// ConflictFail stops the generation with an error
+	ConflictFail
+
+	// ConflictSkip keeps the existing file and does not write the new content
+	ConflictSkip
+
+	// ConflictBackup copies the existing file to a backup file before it is overwritten
+	ConflictBackup
+
+	// ConflictPrompt asks via the Confirm function if the existing file should be overwritten
+	ConflictPrompt
+
+	// ConflictMerge does a three-way merge between the previously generated content, the new
+	// generated content and the existing file. The generated content is recorded inside StateDir.
+	ConflictMerge
+)
+
+// StateDir is the directory beneath the baseDir where the generated content is recorded
+// for the ConflictMerge policy
+const StateDir = ".scaffold"
+
+var conflictPolicyNames = map[ConflictPolicy]string{
+	ConflictOverwrite: "overwrite",
+	ConflictFail:      "fail",
+	ConflictSkip:      "skip",
+	ConflictBackup:    "backup",
+	ConflictPrompt:    "prompt",
+	ConflictMerge:     "merge",
+}
+
+// String returns the name of the policy as accepted by ParseConflictPolicy
+func (c ConflictPolicy) String() string {
+	if name, has := conflictPolicyNames[c]; has {
+		return name
+	}
+	return fmt.Sprintf("ConflictPolicy(%d)", int(c))
+}
+
+// ParseConflictPolicy returns the ConflictPolicy for the given name
+// (one of overwrite, fail, skip, backup, prompt and merge).
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for c, n := range conflictPolicyNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return ConflictOverwrite, fmt.Errorf("unknown conflict policy %#v", name)
+}
+
+// ErrFileExists is returned by Run, if a file already exists and the ConflictPolicy is ConflictFail.
+type ErrFileExists string
+
+func (e ErrFileExists) Error() string {
+	return fmt.Sprintf("file already exists: %#v", string(e))
+}
+
+// the actions that are reported to the log for existing files
+const (
+	actionOverwritten = "overwritten"
+	actionSkipped     = "skipped"
+	actionPrompt      = "prompt"
+	actionMerged      = "merged"
+	actionUnchanged   = "unchanged"
+	actionBackup      = "backup"
+)
+
+// resolveConflict checks if file already exists and handles it according to g.OnConflict.
+// It returns the action to be reported, an empty string means that there is no conflict.
+// The returned content is the content that should be written to the file.
+func (g *Generator) resolveConflict(file string, generated []byte, pos Position) (action string, content []byte, err error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", generated, nil
+		}
+		return "", nil, err
+	}
+
+	if info.IsDir() {
+		return "", nil, fmt.Errorf("not a file: %#v", file)
+	}
+
+	switch g.OnConflict {
+	case ConflictOverwrite:
+		return actionOverwritten, generated, nil
+	case ConflictFail:
+		return "", nil, ErrFileExists(file)
+	case ConflictSkip:
+		return actionSkipped, nil, nil
+	case ConflictBackup:
+		// the backup name is chosen and the backup is created when the files are written
+		return actionBackup, generated, nil
+	case ConflictPrompt:
+		if g.Confirm == nil {
+			return "", nil, ErrFileExists(file)
+		}
+		if g.DryRun {
+			return actionPrompt, generated, nil
+		}
+		var ok bool
+		ok, err = g.Confirm(file)
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			return actionOverwritten, generated, nil
+		}
+		return actionSkipped, nil, nil
+	case ConflictMerge:
+		return g.merge(file, generated, pos)
+	default:
+		return "", nil, fmt.Errorf("unknown conflict policy %s", g.OnConflict)
+	}
+}
+
+// stateFile returns the file inside StateDir where the generated content of file is recorded.
+// Like the generated files, it must not lead outside of the BaseDir (see checkPath).
+func (g *Generator) stateFile(file string, pos Position) (string, error) {
+	rel, err := filepath.Rel(g.BaseDir, file)
+	if err != nil {
+		return "", err
+	}
+	state := filepath.Join(g.BaseDir, StateDir, rel)
+	if err := g.checkPath(state, pos); err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// merge merges the generated content into the existing file. If the generated content of the previous
+// run has been recorded, a three-way merge is done, otherwise every difference is a conflict.
+func (g *Generator) merge(file string, generated []byte, pos Position) (action string, content []byte, err error) {
+	current, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", nil, err
+	}
+
+	state, err := g.stateFile(file, pos)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var conflicts int
+	base, err := ioutil.ReadFile(state)
+	switch {
+	case err == nil:
+		content, conflicts = merge3(base, current, generated)
+	case os.IsNotExist(err):
+		content, conflicts = merge2(current, generated)
+	default:
+		return "", nil, err
+	}
+
+	if conflicts == 0 && bytes.Equal(content, current) {
+		return actionUnchanged, content, nil
+	}
+	return mergeAction(conflicts), content, nil
+}
+
+// saveState records the generated content of f inside StateDir
+func (g *Generator) saveState(j *journal, f *pendingFile) error {
+	state, err := g.stateFile(f.path, f.pos)
+	if err != nil {
+		return err
+	}
+	err = j.mkdirAll(filepath.Dir(state), 0770, nil)
+	if err != nil {
+		return err
+	}
+	return j.writeFile(state, f.generated, 0664)
+}
+
+// reserveBackup chooses the name of the backup of f, so that a file that is written several times
+// by the same run is only backed up once, before it is written for the first time. Later writes
+// just overwrite it. The chosen names are reserved in j, so that they are distinct also in dry runs.
+func (j *journal) reserveBackup(f *pendingFile) {
+	if _, has := j.backups[f.path]; has {
+		f.action = actionOverwritten
+		return
+	}
+	f.backup = backupName(f.path, j.backups)
+	j.backups[f.path] = f.backup
+}
+
+// backup copies the content that f.path had before the run to f.backup.
+// Like the generated files, the backup must not lead outside of the BaseDir (see checkPath).
+func (g *Generator) backup(j *journal, f *pendingFile) error {
+	if err := g.checkPath(f.backup, f.pos); err != nil {
+		return err
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	mode := info.Mode().Perm()
+	current, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	if o, has := j.originals[f.path]; has && o.existed && o.link == "" {
+		current, mode = o.content, o.mode
+	}
+	return j.writeFile(f.backup, current, mode)
+}
+
+// backupName returns the first name of the form file.bak, file.bak.1, file.bak.2 etc.
+// that does not exist yet and is not reserved for another backup.
+func backupName(file string, reserved map[string]string) string {
+	taken := map[string]bool{}
+	for _, name := range reserved {
+		taken[name] = true
+	}
+	name := file + ".bak"
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) && !taken[name] {
+			return name
+		}
+		name = fmt.Sprintf("%s.bak.%d", file, i)
+	}
+}
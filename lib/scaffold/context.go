@@ -0,0 +1,181 @@
+package scaffold
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SyntaxErrors is a list of syntax errors.
+type SyntaxErrors []*SyntaxError
+
+func (s SyntaxErrors) Error() string {
+	msgs := make([]string, len(s))
+	for i, e := range s {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// context is an opened file or folder context
+type context struct {
+	name  string
+	pos   Position
+	attrs Attributes
+}
+
+func (c context) isDir() bool {
+	return strings.HasSuffix(c.name, "/")
+}
+
+func (c context) kind() string {
+	if c.isDir() {
+		return "dir"
+	}
+	return "file"
+}
+
+// contextStack is the stack of the opened contexts, the innermost context is the last one
+type contextStack []context
+
+// push opens the context with the given name (that may be followed by attributes). It returns an error
+// for contexts that are not allowed at the current position or have invalid attributes, but opens them nevertheless.
+func (s *contextStack) push(name string, pos Position) *SyntaxError {
+	c := context{pos: pos}
+	var attrErr error
+	c.name, c.attrs, attrErr = ParseAttributes(name)
+
+	var err *SyntaxError
+	if file, isFile := s.file(); isFile {
+		if c.isDir() {
+			err = &SyntaxError{pos, fmt.Sprintf("embedding folder within file is not allowed (%#v inside %#v)", c.name, file)}
+		} else {
+			err = &SyntaxError{pos, fmt.Sprintf("embedding file within file is not allowed (%#v inside %#v)", c.name, file)}
+		}
+	}
+	if err == nil && attrErr != nil {
+		err = &SyntaxError{pos, fmt.Sprintf("%s of %s %#v", attrErr, c.kind(), c.name)}
+	}
+	*s = append(*s, c)
+	return err
+}
+
+// pop closes the context with the given name. It returns an error if the name does not match the innermost
+// context, but closes the innermost context nevertheless.
+func (s *contextStack) pop(name string, pos Position) *SyntaxError {
+	name = strings.TrimSpace(name)
+	closing := context{name: name, pos: pos}
+	if len(*s) == 0 {
+		return &SyntaxError{pos, fmt.Sprintf("closing %s %#v but there is no open context", closing.kind(), name)}
+	}
+	inner := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	if inner.name != name {
+		return &SyntaxError{pos, fmt.Sprintf("closing %s %#v but should close %s %#v", closing.kind(), name, inner.kind(), inner.name)}
+	}
+	return nil
+}
+
+// innermost returns the innermost context
+func (s contextStack) innermost() context {
+	if len(s) == 0 {
+		return context{}
+	}
+	return s[len(s)-1]
+}
+
+// file returns the name of the innermost context if it is a file context
+func (s contextStack) file() (name string, isFile bool) {
+	if len(s) == 0 || s[len(s)-1].isDir() {
+		return "", false
+	}
+	return s[len(s)-1].name, true
+}
+
+// dir returns the directory of the innermost context beneath baseDir
+func (s contextStack) dir(baseDir string) string {
+	dir := baseDir
+	for _, c := range s {
+		if c.isDir() {
+			dir = filepath.Join(dir, c.name)
+		}
+	}
+	return dir
+}
+
+// dirModes returns the permissions of the directories of the stack beneath baseDir that have a mode attribute
+func (s contextStack) dirModes(baseDir string) map[string]os.FileMode {
+	modes := map[string]os.FileMode{}
+	dir := baseDir
+	for _, c := range s {
+		if c.isDir() {
+			dir = filepath.Join(dir, c.name)
+			if c.attrs.Mode != 0 {
+				modes[dir] = c.attrs.Mode
+			}
+		}
+	}
+	return modes
+}
+
+// unclosed returns an error for each context that is still open
+func (s contextStack) unclosed() SyntaxErrors {
+	var errs SyntaxErrors
+	for _, c := range s {
+		errs = append(errs, &SyntaxError{c.pos, fmt.Sprintf("%s %#v is not closed", c.kind(), c.name)})
+	}
+	return errs
+}
+
+// contextLine returns the name of the context, if the line opens (>>>) or closes (<<<) a context.
+func contextLine(line string) (name string, opens, closes bool) {
+	switch {
+	case strings.HasPrefix(line, ">>>"):
+		return strings.TrimSpace(line[3:]), true, false
+	case strings.HasPrefix(line, "<<<"):
+		return strings.TrimSpace(line[3:]), false, true
+	default:
+		return "", false, false
+	}
+}
+
+// silentActions are the keywords of the template actions that don't render any text by themselves
+var silentActions = []string{"range", "if", "else", "end", "with", "define", "block", "break", "continue"}
+
+// skipActions removes the template actions at the beginning of the line that don't render any text,
+// e.g. "{{range .Models}}>>>{{.}}.go" becomes ">>>{{.}}.go", so that the contexts that follow them
+// are found before the template is rendered. Actions that trim the preceding whitespace ("{{- ")
+// are kept, since they join the line with the previous one.
+func skipActions(line string) string {
+	for strings.HasPrefix(line, "{{") {
+		end := strings.Index(line, "}}")
+		if end == -1 {
+			return line
+		}
+		action := line[2:end]
+		if strings.HasPrefix(action, "-") || !isSilentAction(strings.TrimSpace(action)) {
+			return line
+		}
+		line = line[end+2:]
+	}
+	return line
+}
+
+// isSilentAction checks if the content of the template action renders no text
+func isSilentAction(action string) bool {
+	if strings.HasPrefix(action, "/*") {
+		return true
+	}
+	for _, keyword := range silentActions {
+		if action == keyword || strings.HasPrefix(action, keyword+" ") {
+			return true
+		}
+	}
+	// variable declarations and assignments
+	if strings.HasPrefix(action, "$") {
+		fields := strings.Fields(action)
+		return len(fields) > 1 && (fields[1] == ":=" || fields[1] == "=" || strings.HasSuffix(fields[0], ","))
+	}
+	return false
+}
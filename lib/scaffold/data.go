@@ -0,0 +1,316 @@
+package scaffold
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Decoder decodes the placeholders from the reader.
+type Decoder func(rd io.Reader) (map[string]interface{}, error)
+
+// Decoders provides the decoders for the input formats.
+// New formats can be added as needed. The values returned by a decoder must be
+// of the types returned by encoding/json (see Normalize).
+var Decoders = map[string]Decoder{
+	"json": convertJSON,
+	"yaml": decodeYAML,
+	"toml": decodeTOML,
+	"env":  decodeEnv,
+}
+
+// formatExtensions maps file extensions to input formats
+var formatExtensions = map[string]string{
+	".json": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+	".env":  "env",
+}
+
+// FormatOf returns the input format for the extension of the given file
+// or an empty string if the extension is unknown.
+// Files named .env are of the env format too.
+func FormatOf(file string) string {
+	if filepath.Base(file) == ".env" {
+		return "env"
+	}
+	return formatExtensions[strings.ToLower(filepath.Ext(file))]
+}
+
+// Decode decodes the placeholders of the given format from the reader.
+func Decode(format string, rd io.Reader) (map[string]interface{}, error) {
+	dec, has := Decoders[format]
+	if !has {
+		return nil, fmt.Errorf("unknown input format %#v", format)
+	}
+	return dec(rd)
+}
+
+// DecodeFile decodes the placeholders from the given file. If format is empty,
+// it is derived from the file extension (see FormatOf).
+func DecodeFile(file, format string) (map[string]interface{}, error) {
+	if format == "" {
+		format = FormatOf(file)
+		if format == "" {
+			return nil, fmt.Errorf("unknown input format of %#v", file)
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := Decode(format, f)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode %s: %s", file, err)
+	}
+	return data, nil
+}
+
+// Normalize converts the value to the types that encoding/json returns when decoding
+// into an interface{}, i.e. map[string]interface{}, []interface{}, float64, string, bool and nil.
+// Times are converted to strings in RFC3339 format, other types are formatted with fmt.
+func Normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil, bool, string, float64:
+		return t
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[k] = Normalize(val)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprint(k)] = Normalize(val)
+		}
+		return m
+	case []interface{}:
+		arr := make([]interface{}, len(t))
+		for i, val := range t {
+			arr[i] = Normalize(val)
+		}
+		return arr
+	case []map[string]interface{}:
+		arr := make([]interface{}, len(t))
+		for i, val := range t {
+			arr[i] = Normalize(val)
+		}
+		return arr
+	case int:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	case float32:
+		return float64(t)
+	case time.Time:
+		return t.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+func normalizeMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	return Normalize(m).(map[string]interface{})
+}
+
+func decodeYAML(rd io.Reader) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	err := yaml.NewDecoder(rd).Decode(&data)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return normalizeMap(data), nil
+}
+
+func decodeTOML(rd io.Reader) (map[string]interface{}, error) {
+	tree, err := toml.LoadReader(rd)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeMap(tree.ToMap()), nil
+}
+
+// decodeEnv decodes lines of the form KEY=VALUE. Empty lines and lines starting with # are ignored,
+// as is the prefix "export ". Values might be quoted with double quotes (supporting the escapes of Go strings)
+// or with single quotes (taken literally).
+func decodeEnv(rd io.Reader) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	scanner := bufio.NewScanner(rd)
+	var line int
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		s = strings.TrimPrefix(s, "export ")
+
+		idx := strings.Index(s, "=")
+		if idx < 1 {
+			return nil, fmt.Errorf("syntax error in line %d: missing =", line)
+		}
+		key, val := strings.TrimSpace(s[:idx]), strings.TrimSpace(s[idx+1:])
+
+		switch {
+		case len(val) > 1 && val[0] == '"' && val[len(val)-1] == '"':
+			var err error
+			val, err = strconv.Unquote(val)
+			if err != nil {
+				return nil, fmt.Errorf("syntax error in line %d: %s", line, err)
+			}
+		case len(val) > 1 && val[0] == '\'' && val[len(val)-1] == '\'':
+			val = val[1 : len(val)-1]
+		}
+		data[key] = val
+	}
+	return data, scanner.Err()
+}
+
+// Merge deep merges the given layers of placeholders into a new map, the layers are not modified.
+// Later layers override earlier ones. Objects are merged key by key,
+// all other values (including arrays) are replaced.
+func Merge(layers ...map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for _, layer := range layers {
+		mergeInto(merged, layer)
+	}
+	return merged
+}
+
+func mergeInto(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		switch {
+		case srcIsMap && dstIsMap:
+			mergeInto(dstMap, srcMap)
+		default:
+			dst[k] = copyValue(v)
+		}
+	}
+}
+
+// copyValue returns a deep copy of the objects and arrays inside v
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		mergeInto(m, t)
+		return m
+	case []interface{}:
+		arr := make([]interface{}, len(t))
+		for i, val := range t {
+			arr[i] = copyValue(val)
+		}
+		return arr
+	default:
+		return v
+	}
+}
+
+// Set sets the value at the given dot separated path inside data, e.g. Models.0.Name.
+// Numeric parts of the path are indices of arrays, an index equal to the length of the array
+// appends to it. Missing objects and arrays are created on the fly.
+func Set(data map[string]interface{}, path string, value interface{}) error {
+	_, err := set(data, strings.Split(path, "."), "", value)
+	if err != nil {
+		return fmt.Errorf("can't set %s: %s", path, err)
+	}
+	return nil
+}
+
+// set sets the value at the path given by parts inside the container and returns the
+// container (that has changed for appended arrays). at is the path of the container.
+func set(container interface{}, parts []string, at string, value interface{}) (interface{}, error) {
+	if len(parts) == 0 {
+		return value, nil
+	}
+
+	part := parts[0]
+	path := strings.TrimPrefix(at+"."+part, ".")
+
+	switch c := container.(type) {
+	case nil:
+		if _, err := strconv.Atoi(part); err == nil {
+			return set([]interface{}{}, parts, at, value)
+		}
+		return set(map[string]interface{}{}, parts, at, value)
+	case map[string]interface{}:
+		v, err := set(c[part], parts[1:], path, value)
+		if err != nil {
+			return nil, err
+		}
+		c[part] = v
+		return c, nil
+	case []interface{}:
+		idx, err := strconv.Atoi(part)
+		if err != nil || idx < 0 || idx > len(c) {
+			return nil, fmt.Errorf("invalid index %s", path)
+		}
+		if idx == len(c) {
+			c = append(c, nil)
+		}
+		v, err := set(c[idx], parts[1:], path, value)
+		if err != nil {
+			return nil, err
+		}
+		c[idx] = v
+		return c, nil
+	default:
+		return nil, fmt.Errorf("%s is not an object or array", at)
+	}
+}
+
+// ParseValue parses the given string as json value, if nothing gets lost by that: true, false and null,
+// quoted strings, objects and arrays are converted, numbers only if they are formatted the way json
+// would format them. Everything else is returned as string.
+// So 3 becomes a number, true a boolean and person, 1.10, 007 and 1e3 strings.
+func ParseValue(s string) interface{} {
+	var v interface{}
+	if json.Unmarshal([]byte(s), &v) != nil {
+		return s
+	}
+	if f, isNumber := v.(float64); isNumber && strconv.FormatFloat(f, 'f', -1, 64) != s {
+		return s
+	}
+	return v
+}
+
+// SplitOverrides splits comma separated overrides like Models.0.Name=person,DB.Port=5433.
+// A backslash escapes a comma or a backslash, e.g. Title=Hello\, World.
+func SplitOverrides(s string) []string {
+	var overrides []string
+	var bf strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == ',' || s[i+1] == '\\'):
+			i++
+			bf.WriteByte(s[i])
+		case s[i] == ',':
+			overrides = append(overrides, bf.String())
+			bf.Reset()
+		default:
+			bf.WriteByte(s[i])
+		}
+	}
+	return append(overrides, bf.String())
+}
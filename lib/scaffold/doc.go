@@ -5,7 +5,7 @@
 /*
 Package scaffold provides file and directory generation based on templates.
 
-A template must be UTF8 without byte order marker and have \n (linefeed) as line terminator.
+A template must be UTF8 without byte order marker and have \n (linefeed) or \r\n as line terminator.
 It has a head and a body, separated by an empty line:
 
     1. head (must not contain an empty line)
@@ -16,11 +16,42 @@ The head might contain anything but empty lines, but it is recommended to put so
 json string as example for the usage into it. Also authorship of the template and contact infos can be
 put there.
 
+If the head is a json object with a "$schema" property, it is used as JSON Schema to validate the placeholders
+before they are mixed to the body. Missing required properties and wrong types are reported with the json path
+of the invalid value. Only the keywords type (a single type or a list like ["string", "null"]), properties, required,
+items, enum, default and description are supported, other keywords are ignored.
+
+    {
+      "$schema": "http://json-schema.org/draft-07/schema#",
+      "type": "object",
+      "required": ["Models"],
+      "properties": {
+        "Models": {"type": "array", "items": {"type": "object", "required": ["Name"]}}
+      }
+    }
+
+Default values for the placeholders can be declared inside the head with the "$defaults" property of the json object.
+They are deep merged beneath the given placeholders, so that the template works with partial input.
+Schemas might also use the "default" keyword for properties, which is applied to every object of an array too.
+
+    {
+      "Models": [{"Name": "", "Table": ""}],
+      "$defaults": {"Package": "models"}
+    }
+
+The Prompt function (the new command of the CLI tool) asks for the placeholders based on the json example
+or the schema inside the head.
+
 The syntax of the body is a superset of the Go text/template package (http://golang.org/pkg/text/template).
 The available functions inside the body are extended by the functions defined in the FuncMap variable.
 
 Additionally to the functionality provide via the text/template package there are contexts.
 
+Placeholders that are missing in the json are rendered as "<no value>" by default. In strict mode
+(the Strict field of the Generator, the --strict flag of the CLI tool) a missing placeholder is an error instead.
+Errors of the template refer to the line numbers of the template file, if the Name and LineOffset of the Generator
+are set.
+
 Context
 
 The template body can have folder and file contexts.
@@ -49,10 +80,172 @@ on the fly.
     <<<folderA/
     <<<folder1/
 
+The name of an opening line might be followed by attributes (see Attributes), separated by spaces.
+Attributes either have the form key=value or are flags without a value. Unknown attributes of the form
+key=value are syntax errors. The closing line only repeats the name. The following attributes are supported:
+
+    mode=0755   the permissions of the file or folder (octal, the umask is not applied)
+    ifmissing   the file is only created if it does not exist yet (files only)
+    skipempty   the file is not created if its content is empty or only whitespace (files only)
+    append      the content is appended to the file, if it exists (files only)
+    insert=x    the content is inserted into the existing file before the line with the marker
+                comment "scaffold:insert x" (files only)
+    key=x       the content of an append or insert context is only added, if x is not found at the marker
+    verbatim    the content is written as it is, without being processed by text/template (files only)
+    binary      the content is base64 encoded and written decoded (files only)
+    asset=x     the file x inside the AssetDir of the Generator is copied, the context must be empty (files only)
+    eol=crlf    the line endings of the content are converted to \r\n (or to \n with eol=lf, files only)
+    noeol       the \n after the last line of the content is removed (\r\n with eol=crlf, files only)
+    link=x      the file is a symlink to x (relative to the directory of the symlink), the context must be empty
+
+For example:
+
+    >>>bin/ mode=0755
+    >>>run.sh mode=0755
+    echo "hello"
+    <<<run.sh
+    <<<bin/
+
+The default permissions can be set with the FileMode and DirMode fields of the Generator (the --filemode and
+--dirmode flags of the CLI tool). The umask is applied to them.
+
+Append and insert contexts make it possible to register generated code in existing files, e.g.
+the following adds a route for every model to routes.go that must contain the line "// scaffold:insert routes":
+
+    {{range .Models}}
+    >>>routes.go insert=routes
+        router.Handle("/{{toLower .Name}}", {{.Name}}Handler)
+    <<<routes.go
+    {{end}}
+
+Running the template again does not add the routes twice: the content of append and insert contexts is
+skipped (and reported as unchanged), if it is already found at the marker. Only the block of lines directly before
+the marker line (or at the end of the file for append contexts) is searched: it ends at the previous blank line or
+the previous line that is less indented than the marker line, so the same lines elsewhere in the file don't count.
+If the content might have been changed after it has been added or contains blank lines, a unique key can be declared,
+e.g. ">>>routes.go insert=routes key={{.Name}}Handler". The key is searched in the same block and on the marker line.
+
+Symlinks must point to a target inside the target directory (unless the Generator is Unsafe). An existing
+symlink to the same target is left unchanged, other existing files are handled by the overwrite, skip and prompt
+policies while all other policies fail. Scan creates link contexts for symlinks instead of following them, e.g.
+
+    >>>{{.Service}}/
+    >>>config.json link=../shared/config.json
+    <<<config.json
+    <<<{{.Service}}/
+
+Scan puts binary files base64 encoded into binary contexts (or copies them to an asset directory with
+the Assets option, the --assets flag of the scan command) and text files that contain {{, }} or lines
+that look like contexts into verbatim contexts, so that the generated files are identical to the scanned ones.
+Text files with a line that would close their own verbatim context are treated like binary files.
+Without the eol attribute, the line endings of the template are kept. Scan adds eol=crlf for files with \r\n
+line endings and noeol for files without a line ending after the last line.
+Text outside of file contexts, e.g. the blank lines between the contexts, is not written to any file.
+
+The skipempty attribute is useful for files with conditional content, e.g.
+
+    >>>user_test.go skipempty
+    {{if .WithTests}}...{{end}}
+    <<<user_test.go
+
+The SkipEmpty field of the Generator (the --skipempty flag of the CLI tool) skips every empty file.
+Directories are only created for files that are written, so skipping files leaves no empty directories.
+
+Syntax errors of the contexts (see SyntaxError) refer to the line of the template file and the iterations
+of the range actions that produced the erroneous line, e.g.
+
+    syntax error at models.templ:17 (iteration 1 of range .Models at line 13): closing file "a.go" but should close file "model.go"
+
+Every context must be closed by a line that repeats its name. Contexts that are still open at the end of the
+body are reported as errors.
+
 The placeholders inside the body are organized as a json object / map. When the Run function is called, the
 json objects is mixed to the template and after that the folders and files are created as defined in the
 result. That makes it possible to use placeholders as parts of folder or file names.
 
+Since the names of the folders and files may come from the placeholders, every path is resolved before a file
+is written. Paths that lead outside of the target directory - via .. or via symlinks that already exist inside
+the target directory - are refused with an UnsafePathError, as are asset contexts that refer to files
+outside of the AssetDir. For trusted templates the check can be disabled
+with the Unsafe field of the Generator (the --unsafe flag of the CLI tool).
+
+The generation is all-or-nothing: the whole body is rendered and checked before the first file is written.
+If writing a file fails (or an AfterWrite hook returns an error), the files written so far are restored or removed,
+as are the created directories and backups.
+
+Lint
+
+The Lint method (the lint command of the CLI tool) checks a template without any placeholders.
+It reports syntax errors of the contexts, functions that are not part of the FuncMap and - if the head
+is a json example or a schema - fields that are neither part of the example nor of its $defaults as well as
+names of contexts that would be empty or contain a path separator when rendered with the example.
+The referenced fields are listed like
+
+    Models
+    Models[].Name
+    Project
+
+The lint command prints the fields to stdout and the problems to stderr and exits with code 1 if problems were found.
+
+Template directories
+
+Instead of a single file, a template might be a directory (see ReadTemplateDir and Generator.RunDir). Every file
+and directory inside it becomes a context of the same name, so names may contain placeholders, either as {{...}}
+or - as with Scan - as #Name, e.g. "models/#Name/{{toLower .Name}}.go". The content of text files is rendered
+like the body of a template file and must not contain lines that start with >>> or <<<. Binary files are copied
+as they are. The head is read from the file scaffold.head (see HeadFile) in the root of the directory, which is
+not generated itself. Errors refer to the lines of the files inside the directory (see Generator.Sources), errors
+in the names of files and directories to their paths. The CLI tool detects whether --template points to a file
+or a directory. It only uses directories that contain the head file (which might be empty) and prefers template
+files, so that a directory of generated files is not taken as template by accident.
+
+Existing files
+
+By default, files that already exist are overwritten. This can be changed with the OnConflict option
+of the Run function (the --onconflict flag of the CLI tool). The following policies are available:
+
+    overwrite   replace the existing file (default)
+    fail        stop with an error
+    skip        keep the existing file
+    backup      copy the existing file to [file].bak before overwriting it
+    prompt      ask for each existing file, if it should be overwritten
+    merge       merge the changes of the existing file with the newly generated content
+
+The action taken for each existing file is reported after its name in the log.
+
+The merge policy records the generated content of every file inside the .scaffold directory
+beneath baseDir. When the template is run again, a three-way merge between the previously
+generated content, the newly generated content and the existing file is done, so that the edits
+made after the previous generation are kept. Lines that were changed differently on both sides
+are surrounded by conflict markers:
+
+    <<<<<<< current
+    the line as edited after the previous generation
+    =======
+    the line as generated now
+    >>>>>>> generated
+
+Use the merge policy for the first generation too, so that there is a recorded state to merge against.
+Without it, every difference between the existing file and the generated content is a conflict.
+
+Plan
+
+The Plan method of the Generator makes a dry run and reports for every file and directory, whether it would be
+created, modified or left unchanged. Modifications come with a unified diff against the current content.
+A Plan can be marshalled to JSON, the CLI tool prints it via
+
+    scaffold test --json -t=models.templ < models.json
+
+Input formats
+
+Besides json, the placeholders can be decoded from YAML, TOML and dotenv files (see Decoders and DecodeFile).
+All formats are normalized to the types that encoding/json returns, so the template body does not
+depend on the input format.
+
+Multiple sources of placeholders can be deep merged with the Merge function and single values can be
+set via paths like Models.0.Name with the Set function. ParseValue converts the values of the --set flag
+of the CLI tool, SplitOverrides splits them.
+
 Escaping of double curly braces and dollar chars
 
 Curly braces and dollar chars are part of syntax of the go template engine and there
@@ -63,6 +256,18 @@ included some helper functions that return them.
 
 will result in the string "{{$}}".
 
+Library usage
+
+The Run function covers the usage of the CLI tool. Programs that embed scaffold and need more settings
+(additional template functions, file permissions, hooks etc.) should use a Generator:
+
+	g := &scaffold.Generator{
+		BaseDir: "src",
+		Data:    map[string]interface{}{"Name": "person"},
+		FuncMap: template.FuncMap{"plural": plural},
+	}
+	err := g.Run(body)
+
 Most of the time this package will be used via the scaffold command sub package.
 
 It can be installed via
@@ -0,0 +1,214 @@
+package scaffold
+
+import (
+	"io"
+	"os"
+	"text/template"
+)
+
+// the default permissions of created files and directories
+const (
+	DefaultFileMode os.FileMode = 0664
+	DefaultDirMode  os.FileMode = 0770
+)
+
+// Hooks are called while the files are created. Each hook is optional.
+type Hooks struct {
+
+	// BeforeWrite is called with the generated content before a file is written.
+	// The returned content is written instead.
+	BeforeWrite func(file string, content []byte) ([]byte, error)
+
+	// AfterWrite is called after a file has been written.
+	AfterWrite func(file string) error
+}
+
+// Generator creates files and directories beneath BaseDir based on a template body.
+// The zero value of every field is a usable default.
+type Generator struct {
+
+	// BaseDir is the directory beneath which the files and directories are created
+	BaseDir string
+
+	// Data are the placeholders that are mixed to the template body
+	Data map[string]interface{}
+
+	// Defaults are deep merged beneath Data (see Merge)
+	Defaults map[string]interface{}
+
+	// Schema validates Data before it is mixed to the template body (if not nil)
+	Schema *Schema
+
+	// Strict makes the generation fail if the template body refers to a missing placeholder
+	Strict bool
+
+	// Name is the name of the template used in error messages (e.g. the template file)
+	Name string
+
+	// LineOffset is the number of lines of the template file that precede the body (see BodyOffset).
+	// It is added to the line numbers in error messages.
+	LineOffset int
+
+	// Sources map the lines of a body that was read from a template directory to its files (see ReadTemplateDir),
+	// so that errors refer to them instead of to Name and LineOffset
+	Sources Sources
+
+	// FuncMap contains functions that are available inside the template body
+	// in addition to the package level FuncMap
+	FuncMap template.FuncMap
+
+	// OnConflict defines, what happens with files that already exist
+	OnConflict ConflictPolicy
+
+	// Confirm is asked for the ConflictPrompt policy. It receives the path of the
+	// existing file and returns true if it should be overwritten.
+	// Without a confirm function, ConflictPrompt fails on existing files.
+	Confirm func(file string) (bool, error)
+
+	// FileMode are the permissions of created files (defaults to DefaultFileMode).
+	// The umask is applied. The mode attribute of a file context overrides it, e.g. ">>>run.sh mode=0755".
+	FileMode os.FileMode
+
+	// DirMode are the permissions of created directories (defaults to DefaultDirMode).
+	// The umask is applied. The mode attribute of a dir context overrides it, e.g. ">>>bin/ mode=0700".
+	DirMode os.FileMode
+
+	// SkipEmpty skips files with empty content (or only whitespace). Directories are only created for
+	// files that are written, so no empty directories are left. The skipempty attribute does the same
+	// for single file contexts.
+	SkipEmpty bool
+
+	// Unsafe allows the template to write files outside of BaseDir. By default the rendered names
+	// of the contexts are checked, also against symlinks inside the target tree (see UnsafePathError).
+	// It should only be set for trusted templates and placeholders.
+	Unsafe bool
+
+	// AssetDir is the directory of the files that are referenced by asset contexts
+	// (">>>logo.png asset=img/logo.png"). It defaults to the working directory.
+	// Assets outside of it are refused with an UnsafePathError, unless the Generator is Unsafe.
+	AssetDir string
+
+	// DryRun reports what would be done without creating any files and directories
+	DryRun bool
+
+	// Hooks are called while the files are created
+	Hooks Hooks
+
+	// Log receives the name of every file that is written (if not nil)
+	Log io.Writer
+
+	// plan collects the changes if not nil (see Plan)
+	plan    *Plan
+	planned map[string]bool
+}
+
+// RunOption is an option for Run
+type RunOption func(*Generator)
+
+// OnConflict sets the ConflictPolicy for files that already exist.
+func OnConflict(policy ConflictPolicy) RunOption {
+	return func(g *Generator) {
+		g.OnConflict = policy
+	}
+}
+
+// Strict makes Run fail if the template body refers to a missing placeholder.
+func Strict() RunOption {
+	return func(g *Generator) {
+		g.Strict = true
+	}
+}
+
+// FileMode sets the default permissions of created files (see Generator.FileMode).
+func FileMode(mode os.FileMode) RunOption {
+	return func(g *Generator) {
+		g.FileMode = mode
+	}
+}
+
+// DirMode sets the default permissions of created directories (see Generator.DirMode).
+func DirMode(mode os.FileMode) RunOption {
+	return func(g *Generator) {
+		g.DirMode = mode
+	}
+}
+
+// SkipEmpty makes Run skip files with empty content (see Generator.SkipEmpty).
+func SkipEmpty() RunOption {
+	return func(g *Generator) {
+		g.SkipEmpty = true
+	}
+}
+
+// Unsafe allows Run to write files outside of baseDir.
+func Unsafe() RunOption {
+	return func(g *Generator) {
+		g.Unsafe = true
+	}
+}
+
+// Confirm sets the function that is asked for the ConflictPrompt policy.
+func Confirm(fn func(file string) (bool, error)) RunOption {
+	return func(g *Generator) {
+		g.Confirm = fn
+	}
+}
+
+// Run mixes g.Data to the template body. The result is then used
+// to create files and directories beneath g.BaseDir.
+func (g *Generator) Run(body string) error {
+
+	var (
+		err       error
+		data      map[string]interface{}
+		generator io.Reader
+		sm        *sourceMap
+		verbatim  [][]byte
+	)
+
+steps:
+	for jump := 1; err == nil; jump++ {
+		switch jump - 1 {
+		default:
+			break steps
+		case 0:
+			data = Merge(g.Defaults, g.Data)
+			if g.Schema != nil {
+				g.Schema.ApplyDefaults(data)
+				err = g.Schema.Validate(data)
+			}
+		case 1:
+			body, verbatim = extractVerbatim(body)
+			generator, sm, err = g.mix(body, data)
+		case 2:
+			err = g.parseGenerator(generator, sm, verbatim)
+		}
+	}
+	return err
+}
+
+// RunDir runs the body of the template directory dir (see ReadTemplateDir). Errors refer to the files inside it.
+// As with Run, the head is not interpreted: Schema and Defaults must be set by the caller.
+func (g *Generator) RunDir(dir string) error {
+	_, body, sources, err := ReadTemplateDir(dir)
+	if err != nil {
+		return err
+	}
+	d := *g
+	d.Sources = sources
+	return d.Run(body)
+}
+
+func (g *Generator) fileMode() os.FileMode {
+	if g.FileMode == 0 {
+		return DefaultFileMode
+	}
+	return g.FileMode
+}
+
+func (g *Generator) dirMode() os.FileMode {
+	if g.DirMode == 0 {
+		return DefaultDirMode
+	}
+	return g.DirMode
+}
@@ -0,0 +1,143 @@
+package scaffold
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// InsertMarker is the prefix of the marker comments, before which the content of insert contexts is inserted,
+// e.g. "// scaffold:insert routes" for the context ">>>routes.go insert=routes".
+const InsertMarker = "scaffold:insert"
+
+// actions for content that is injected into existing files
+const (
+	actionAppended = "appended"
+	actionInserted = "inserted"
+)
+
+// currentContent returns the content of the file after the already prepared files have been written
+func currentContent(file string, prepared []*pendingFile) (content []byte, exists bool, err error) {
+	for i := len(prepared) - 1; i >= 0; i-- {
+		if p := prepared[i]; p.path == file && p.action != actionSkipped {
+			return p.content, true, nil
+		}
+	}
+
+	content, err = ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	return content, err == nil, err
+}
+
+// inject appends the generated content to the file or inserts it at the marker, as defined by the attributes.
+// Missing files are created by append contexts, but are an error for insert contexts.
+// If the content has already been injected, the file is unchanged (see isInjected).
+func (g *Generator) inject(file string, generated []byte, attrs Attributes, prepared []*pendingFile) (action string, content []byte, err error) {
+	current, exists, err := currentContent(file, prepared)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if attrs.Append {
+		if !exists {
+			return "", generated, nil
+		}
+		if isInjected(current, nil, generated, attrs.Key) {
+			return actionUnchanged, current, nil
+		}
+		content = append([]byte(nil), current...)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			content = append(content, '\n')
+		}
+		return actionAppended, append(content, generated...), nil
+	}
+
+	if !exists {
+		return "", nil, fmt.Errorf("can't insert into %#v: file does not exist", file)
+	}
+
+	at := insertOffset(current, attrs.Insert)
+	if at < 0 {
+		return "", nil, fmt.Errorf("can't insert into %#v: missing marker %#v", file, InsertMarker+" "+attrs.Insert)
+	}
+
+	marker := current[at:]
+	if idx := bytes.IndexByte(marker, '\n'); idx >= 0 {
+		marker = marker[:idx]
+	}
+	if isInjected(current[:at], marker, generated, attrs.Key) {
+		return actionUnchanged, current, nil
+	}
+
+	content = make([]byte, 0, len(current)+len(generated))
+	content = append(content, current[:at]...)
+	content = append(content, generated...)
+	content = append(content, current[at:]...)
+	return actionInserted, content, nil
+}
+
+// insertOffset returns the offset of the start of the first line that contains the insert marker
+// with the given name, or -1 if there is no such line.
+func insertOffset(content []byte, name string) int {
+	re := regexp.MustCompile(regexp.QuoteMeta(InsertMarker) + `[ \t]+` + regexp.QuoteMeta(name) + `(\s|$)`)
+	loc := re.FindIndex(content)
+	if loc == nil {
+		return -1
+	}
+	return bytes.LastIndexByte(content[:loc[0]], '\n') + 1
+}
+
+// isInjected checks if the content has already been injected at the marker line (nil for append contexts),
+// before which is the text before the marker (or the whole file for append contexts). Only the injected block
+// (see injectedBlock) is searched, so that the same lines elsewhere in the file don't count: either the block
+// or the marker line contains the key or - without a key - the block contains the lines of the content.
+func isInjected(before, marker, content []byte, key string) bool {
+	block := injectedBlock(before, indentation(marker))
+	if key != "" {
+		return bytes.Contains(block, []byte(key)) || bytes.Contains(marker, []byte(key))
+	}
+
+	// the block never contains blank lines, so they are not compared
+	lines := bytes.Split(content, []byte("\n"))
+	for len(lines) > 0 && len(bytes.TrimSpace(lines[0])) == 0 {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && len(bytes.TrimSpace(lines[len(lines)-1])) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return false
+	}
+	trimmed := append(bytes.Join(lines, []byte("\n")), '\n')
+	return bytes.HasPrefix(block, trimmed) || bytes.Contains(block, append([]byte("\n"), trimmed...))
+}
+
+// injectedBlock returns the lines at the end of text that may have been injected before: blank lines at the end
+// are skipped, the block starts after the previous blank line or the previous line that does not start with indent.
+// The returned block ends with a line ending.
+func injectedBlock(text, indent []byte) []byte {
+	lines := bytes.SplitAfter(text, []byte("\n"))
+	end := len(lines)
+	for end > 0 && len(bytes.TrimSpace(lines[end-1])) == 0 {
+		end--
+	}
+	start := end
+	for start > 0 && len(bytes.TrimSpace(lines[start-1])) > 0 && bytes.HasPrefix(lines[start-1], indent) {
+		start--
+	}
+
+	block := bytes.Join(lines[start:end], nil)
+	if len(block) > 0 && block[len(block)-1] != '\n' {
+		block = append(block, '\n')
+	}
+	return block
+}
+
+// indentation returns the leading spaces and tabs of the line
+func indentation(line []byte) []byte {
+	return line[:len(line)-len(bytes.TrimLeft(line, " \t"))]
+}
@@ -0,0 +1,110 @@
+package scaffold
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkLink checks, if the symlink file and its target are beneath the BaseDir.
+// Relative targets are relative to the directory of the symlink.
+// Nothing is checked if the Generator is Unsafe.
+func (g *Generator) checkLink(file string, target string, pos Position) error {
+	// the symlink itself is replaced, so only its directory must be inside
+	if err := g.checkPath(filepath.Dir(file), pos); err != nil {
+		return err
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(file), target)
+	}
+	if err := g.checkPath(target, pos); err != nil {
+		if u, is := err.(*UnsafePathError); is {
+			return &UnsafePathError{Pos: u.Pos, Path: file + " -> " + u.Path, Resolved: u.Resolved}
+		}
+		return err
+	}
+	return nil
+}
+
+// prepareLink prepares the creation of the symlink file without touching the file system.
+// The content of the context must be blank. If the file already exists and is not a symlink to the
+// same target, g.OnConflict decides what happens (only ConflictOverwrite, ConflictSkip and ConflictPrompt
+// are supported, the other policies fail).
+func (g *Generator) prepareLink(file string, generated []byte, attrs Attributes) (*pendingFile, error) {
+	if len(bytes.TrimSpace(generated)) > 0 {
+		return nil, fmt.Errorf("symlink %#v must not have content", file)
+	}
+
+	var action string
+	info, err := os.Lstat(file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case info.IsDir():
+		return nil, fmt.Errorf("not a file: %#v", file)
+	case info.Mode()&os.ModeSymlink != 0 && readlink(file) == attrs.Link:
+		action = actionUnchanged
+	case attrs.IfMissing || g.OnConflict == ConflictSkip:
+		action = actionSkipped
+	case g.OnConflict == ConflictOverwrite:
+		action = actionOverwritten
+	case g.OnConflict == ConflictPrompt && g.Confirm != nil:
+		action = actionPrompt
+		if !g.DryRun {
+			ok, err := g.Confirm(file)
+			if err != nil {
+				return nil, err
+			}
+			action = actionSkipped
+			if ok {
+				action = actionOverwritten
+			}
+		}
+	default:
+		return nil, ErrFileExists(file)
+	}
+
+	if g.plan != nil {
+		if err := g.planLink(file, attrs.Link, action); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pendingFile{path: file, action: action, attrs: attrs}, nil
+}
+
+// readlink returns the target of the symlink or an empty string if it is no symlink
+func readlink(file string) string {
+	target, _ := os.Readlink(file)
+	return target
+}
+
+// planLink adds the symlink to the plan
+func (g *Generator) planLink(file, target, action string) error {
+	if action != actionSkipped {
+		g.planDirs(filepath.Dir(file))
+	}
+
+	rel, err := filepath.Rel(g.BaseDir, file)
+	if err != nil {
+		return err
+	}
+	c := Change{Path: filepath.ToSlash(rel), Link: target}
+
+	switch action {
+	case "":
+		c.Action = ActionCreate
+	case actionSkipped:
+		c.Action = ActionSkip
+	case actionUnchanged:
+		c.Action = ActionUnchanged
+	default:
+		c.Action = ActionModify
+	}
+
+	*g.plan = append(*g.plan, c)
+	return nil
+}
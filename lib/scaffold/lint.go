@@ -0,0 +1,481 @@
+package scaffold
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// LintError is a problem of a template that is found by Lint.
+type LintError struct {
+	Pos Position
+	Msg string
+}
+
+func (l *LintError) Error() string {
+	return fmt.Sprintf("%s: %s", l.Pos, l.Msg)
+}
+
+// LintErrors are all problems found by Lint (*SyntaxError and *LintError).
+type LintErrors []error
+
+func (l LintErrors) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// builtins are the predefined functions of text/template
+var builtins = map[string]bool{
+	"and": true, "or": true, "not": true, "len": true, "index": true, "slice": true,
+	"print": true, "printf": true, "println": true, "html": true, "js": true, "urlquery": true,
+	"call": true, "eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+}
+
+// fieldPath is the path of a field inside the placeholders, e.g. [Models [] Name]
+// for the Name of every entry of the Models. A nil fieldPath is unknown.
+type fieldPath []string
+
+func (f fieldPath) String() string {
+	return strings.Replace(strings.Join(f, "."), ".[]", "[]", -1)
+}
+
+func (f fieldPath) child(names ...string) fieldPath {
+	if f == nil {
+		return nil
+	}
+	c := make(fieldPath, len(f), len(f)+len(names))
+	copy(c, f)
+	return append(c, names...)
+}
+
+// linter walks the parse trees of the template body
+type linter struct {
+	g       *Generator
+	sm      *sourceMap
+	example interface{}
+	errs    LintErrors
+
+	// fields are the referenced fields and the position of their first reference
+	fields map[string]parse.Pos
+
+	// lineDots are the paths of the dot at the start of the lines of the body
+	lineDots map[int]fieldPath
+}
+
+// Lint checks the template body without mixing any placeholders into it:
+//
+//   - the contexts are checked for syntax errors, the lines that open and close contexts are
+//     compared as they are written, so a context opened with ">>>{{.Name}}/" must be closed with "<<<{{.Name}}/"
+//   - functions that are neither builtin nor part of the FuncMaps are reported
+//   - if the head contains a json example or a schema, the referenced fields are checked against it
+//     (extended by the $defaults of the head)
+//     and the names of the contexts are rendered with the example to detect names that are empty or contain
+//     path separators
+//
+// Lint returns the referenced fields (like Models[].Name) and all problems as LintErrors, ordered by line.
+// The returned error is nil if no problems were found.
+func (g *Generator) Lint(head, body string) (fields []string, err error) {
+	// the content of verbatim contexts is not part of the template
+	body, _ = extractVerbatim(body)
+
+	l := &linter{
+		g:        g,
+		sm:       newSourceMap(g.templateName(), g.LineOffset, body),
+		fields:   map[string]parse.Pos{},
+		lineDots: map[int]fieldPath{},
+	}
+	l.sm.sources = g.Sources
+
+	if schema, _ := ParseSchema(head); schema != nil {
+		l.example = schema.example()
+	} else if ex, err := parseExample(head); err == nil {
+		l.example = ex
+	}
+
+	// the placeholders declared by $defaults are available too
+	if defaults, _ := HeadDefaults(head); l.example != nil && defaults != nil {
+		l.example = mergeExample(l.example, defaults)
+	}
+
+	l.lintContexts(body)
+	l.lintTemplate(body)
+
+	for f := range l.fields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	if len(l.errs) > 0 {
+		sort.SliceStable(l.errs, func(a, b int) bool {
+			return errorLine(l.errs[a]) < errorLine(l.errs[b])
+		})
+		return fields, l.errs
+	}
+	return fields, nil
+}
+
+// errorLine returns the line of a problem found by Lint or 0 if it is unknown
+func errorLine(err error) int {
+	switch e := err.(type) {
+	case *SyntaxError:
+		return e.Pos.Line
+	case *LintError:
+		return e.Pos.Line
+	default:
+		return 0
+	}
+}
+
+func (l *linter) errorf(pos parse.Pos, format string, args ...interface{}) {
+	l.errs = append(l.errs, &LintError{l.sm.position(l.sm.line(pos)), fmt.Sprintf(format, args...)})
+}
+
+// lintContexts checks the syntax of the contexts. Contexts may follow actions that render no text
+// on the same line, e.g. "{{range .Models}}>>>{{.}}.go".
+func (l *linter) lintContexts(body string) {
+	var stack contextStack
+
+	for i, line := range strings.Split(body, "\n") {
+		name, opens, closes := contextLine(skipActions(line))
+		if !opens && !closes {
+			continue
+		}
+
+		pos := l.sm.position(i + 1 + l.g.LineOffset)
+		pos.Rendered = i
+		var err *SyntaxError
+		switch {
+		case name == "":
+			err = &SyntaxError{pos, "missing name of context"}
+		case opens:
+			err = stack.push(name, pos)
+		default:
+			err = stack.pop(name, pos)
+		}
+
+		if err != nil {
+			l.errs = append(l.errs, err)
+		}
+	}
+
+	for _, err := range stack.unclosed() {
+		l.errs = append(l.errs, err)
+	}
+}
+
+// lintTemplate checks the functions and fields and the names of the contexts
+func (l *linter) lintTemplate(body string) {
+	tr := parse.New(l.sm.file)
+	tr.Mode = parse.SkipFuncCheck
+	trees := map[string]*parse.Tree{}
+	_, err := tr.Parse(body, "", "", trees)
+	if err != nil {
+		l.errs = append(l.errs, l.g.templateError(l.sm.file, err))
+		return
+	}
+
+	for name, t := range trees {
+		var dot fieldPath
+		// the dot of defined templates is unknown
+		if name == l.sm.file {
+			dot = fieldPath{}
+		}
+		l.walk(t.Root, dot, map[string]fieldPath{"$": dot})
+	}
+
+	l.lintContextNames(body)
+}
+
+func (l *linter) walk(node parse.Node, dot fieldPath, vars map[string]fieldPath) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			l.walk(c, dot, vars)
+		}
+	case *parse.TextNode:
+		l.markLines(n, dot)
+	case *parse.ActionNode:
+		l.pipe(n.Pipe, dot, vars)
+	case *parse.IfNode:
+		l.pipe(n.Pipe, dot, vars)
+		l.walk(n.List, dot, vars)
+		l.walk(n.ElseList, dot, vars)
+	case *parse.WithNode:
+		l.walk(n.List, l.pipe(n.Pipe, dot, vars), vars)
+		l.walk(n.ElseList, dot, vars)
+	case *parse.RangeNode:
+		elem := l.pipe(n.Pipe, dot, vars).child("[]")
+		inner := vars
+		if len(n.Pipe.Decl) > 0 {
+			inner = copyVars(vars)
+			// the last declared variable is the element, a preceding one the index
+			inner[n.Pipe.Decl[len(n.Pipe.Decl)-1].Ident[0]] = elem
+			if len(n.Pipe.Decl) > 1 {
+				inner[n.Pipe.Decl[0].Ident[0]] = nil
+			}
+		}
+		l.walk(n.List, elem, inner)
+		l.walk(n.ElseList, dot, vars)
+	case *parse.TemplateNode:
+		l.pipe(n.Pipe, dot, vars)
+	}
+}
+
+func copyVars(vars map[string]fieldPath) map[string]fieldPath {
+	c := make(map[string]fieldPath, len(vars))
+	for k, v := range vars {
+		c[k] = v
+	}
+	return c
+}
+
+// pipe checks the commands of the pipeline and returns the path of its value
+// if it is a single field (otherwise nil).
+func (l *linter) pipe(p *parse.PipeNode, dot fieldPath, vars map[string]fieldPath) (value fieldPath) {
+	if p == nil {
+		return nil
+	}
+
+	for i, cmd := range p.Cmds {
+		for _, arg := range cmd.Args {
+			path := l.arg(arg, dot, vars)
+			if i == 0 && len(p.Cmds) == 1 && len(cmd.Args) == 1 {
+				value = path
+			}
+		}
+	}
+
+	// variables declared by the pipeline ({{$m := .Models}}) are valid until the end of the template
+	if len(p.Decl) == 1 && !p.IsAssign {
+		vars[p.Decl[0].Ident[0]] = value
+	}
+	return value
+}
+
+// arg checks the argument of a command and returns its path, if it is a field
+func (l *linter) arg(arg parse.Node, dot fieldPath, vars map[string]fieldPath) fieldPath {
+	switch a := arg.(type) {
+	case *parse.FieldNode:
+		return l.field(a.Pos, dot.child(a.Ident...))
+	case *parse.VariableNode:
+		base, has := vars[a.Ident[0]]
+		if !has {
+			return nil
+		}
+		return l.field(a.Pos, base.child(a.Ident[1:]...))
+	case *parse.DotNode:
+		return dot
+	case *parse.IdentifierNode:
+		if !builtins[a.Ident] && FuncMap[a.Ident] == nil && l.g.FuncMap[a.Ident] == nil {
+			l.errorf(a.Pos, "unknown function %#v", a.Ident)
+		}
+	case *parse.PipeNode:
+		return l.pipe(a, dot, vars)
+	case *parse.ChainNode:
+		l.arg(a.Node, dot, vars)
+	}
+	return nil
+}
+
+// field registers the referenced field and checks it against the example
+func (l *linter) field(pos parse.Pos, path fieldPath) fieldPath {
+	if len(path) == 0 {
+		return path
+	}
+
+	name := path.String()
+	if _, has := l.fields[name]; has {
+		return path
+	}
+	l.fields[name] = pos
+
+	if l.example != nil && !exampleHas(l.example, path) {
+		l.errorf(pos, "unknown field %s", name)
+	}
+	return path
+}
+
+// exampleHas checks if the example has the given path.
+// Paths into empty arrays or null values are not checked.
+func exampleHas(example interface{}, path fieldPath) bool {
+	for _, p := range path {
+		switch ex := example.(type) {
+		case *exampleObject:
+			val, has := ex.values[p]
+			if !has {
+				return false
+			}
+			example = val
+		case []interface{}:
+			if p != "[]" {
+				return false
+			}
+			if len(ex) == 0 {
+				return true
+			}
+			example = ex[0]
+		case nil:
+			return true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// mergeExample adds the properties of the default values to the objects of the example that don't have them
+func mergeExample(example, defaults interface{}) interface{} {
+	obj, isObj := example.(*exampleObject)
+	def, isMap := defaults.(map[string]interface{})
+	if !isObj || !isMap {
+		if example == nil {
+			return exampleOf(defaults)
+		}
+		return example
+	}
+
+	merged := &exampleObject{keys: append([]string(nil), obj.keys...), values: map[string]interface{}{}}
+	for k, v := range obj.values {
+		merged.values[k] = v
+	}
+
+	var keys []string
+	for k := range def {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, has := merged.values[k]; !has {
+			merged.keys = append(merged.keys, k)
+		}
+		merged.values[k] = mergeExample(merged.values[k], def[k])
+	}
+	return merged
+}
+
+// exampleOf converts decoded json to the types of parseExample
+func exampleOf(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return mergeExample(&exampleObject{values: map[string]interface{}{}}, val)
+	case []interface{}:
+		arr := make([]interface{}, len(val))
+		for i, item := range val {
+			arr[i] = exampleOf(item)
+		}
+		return arr
+	case float64:
+		return json.Number(strconv.FormatFloat(val, 'f', -1, 64))
+	default:
+		return val
+	}
+}
+
+// markLines records the dot for the lines that start inside the text node
+func (l *linter) markLines(n *parse.TextNode, dot fieldPath) {
+	line := l.sm.line(n.Pos) - l.sm.offset
+	start := int(n.Pos) == l.sm.lineStarts[line-1]
+	for i, b := range n.Text {
+		if (i == 0 && start) || (i > 0 && n.Text[i-1] == '\n') {
+			if _, has := l.lineDots[line]; !has {
+				l.lineDots[line] = dot
+			}
+		}
+		if b == '\n' {
+			line++
+		}
+	}
+}
+
+// lintContextNames renders the names of the contexts with the example (using x for empty strings)
+// and reports empty names and names containing path separators.
+func (l *linter) lintContextNames(body string) {
+	sample := sampleOf(l.example)
+
+	for i, line := range strings.Split(body, "\n") {
+		name, opens, _ := contextLine(line)
+		name, _, _ = ParseAttributes(name)
+		if !opens || name == "" {
+			continue
+		}
+		pos := parse.Pos(l.sm.lineStarts[i])
+		dot, has := l.lineDots[i+1]
+		if sample == nil || !has || dot == nil || !strings.Contains(name, "{{") {
+			continue
+		}
+
+		t, err := template.New("name").Funcs(FuncMap).Funcs(l.g.FuncMap).Parse(name)
+		if err != nil {
+			continue
+		}
+		var bf bytes.Buffer
+		if t.Execute(&bf, sampleAt(sample, dot)) != nil {
+			continue
+		}
+		rendered := bf.String()
+		if strings.HasSuffix(name, "/") {
+			rendered = strings.TrimSuffix(rendered, "/")
+		}
+
+		switch {
+		case strings.TrimSpace(rendered) == "":
+			l.errorf(pos, "name of context %#v is empty after rendering", name)
+		case strings.ContainsAny(rendered, `/\`):
+			l.errorf(pos, "name of context %#v contains a path separator after rendering (%#v)", name, rendered)
+		}
+	}
+}
+
+// sampleOf converts the example to placeholders, replacing empty strings by "x"
+func sampleOf(example interface{}) interface{} {
+	switch ex := example.(type) {
+	case *exampleObject:
+		m := map[string]interface{}{}
+		for k, v := range ex.values {
+			m[k] = sampleOf(v)
+		}
+		return m
+	case []interface{}:
+		arr := make([]interface{}, len(ex))
+		for i, v := range ex {
+			arr[i] = sampleOf(v)
+		}
+		return arr
+	case string:
+		if ex == "" {
+			return "x"
+		}
+		return ex
+	default:
+		return ex
+	}
+}
+
+// sampleAt returns the value of the sample at the given path, using the first entry of arrays
+func sampleAt(sample interface{}, path fieldPath) interface{} {
+	for _, p := range path {
+		switch s := sample.(type) {
+		case map[string]interface{}:
+			sample = s[p]
+		case []interface{}:
+			if len(s) == 0 {
+				return nil
+			}
+			sample = s[0]
+		default:
+			return nil
+		}
+	}
+	return sample
+}
@@ -0,0 +1,195 @@
+package scaffold
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// the markers that surround conflicting lines in merged files
+const (
+	conflictStart  = "<<<<<<< current\n"
+	conflictMiddle = "=======\n"
+	conflictEnd    = ">>>>>>> generated\n"
+)
+
+// splitLines splits b into lines, keeping the line terminators.
+func splitLines(b []byte) []string {
+	var lines []string
+	for len(b) > 0 {
+		idx := bytes.IndexByte(b, '\n')
+		if idx == -1 {
+			lines = append(lines, string(b))
+			break
+		}
+		lines = append(lines, string(b[:idx+1]))
+		b = b[idx+1:]
+	}
+	return lines
+}
+
+// matchLines returns for each line of a the index of the corresponding line in b
+// or -1, if the line is not part of the longest common subsequence of a and b.
+func matchLines(a, b []string) []int {
+	m := make([]int, len(a))
+	for i := range m {
+		m[i] = -1
+	}
+
+	// common prefix and suffix are matched without the expensive table
+	var pre int
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		m[pre] = pre
+		pre++
+	}
+
+	var suf int
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		m[len(a)-1-suf] = len(b) - 1 - suf
+		suf++
+	}
+
+	as, bs := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	if len(as) == 0 || len(bs) == 0 {
+		return m
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of as[i:] and bs[j:]
+	width := len(bs) + 1
+	lcs := make([]int32, (len(as)+1)*width)
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			switch {
+			case as[i] == bs[j]:
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			case lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+				lcs[i*width+j] = lcs[(i+1)*width+j]
+			default:
+				lcs[i*width+j] = lcs[i*width+j+1]
+			}
+		}
+	}
+
+	for i, j := 0, 0; i < len(as) && j < len(bs); {
+		switch {
+		case as[i] == bs[j]:
+			m[pre+i] = pre + j
+			i++
+			j++
+		case lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return m
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeConflict writes the conflicting lines of current and generated surrounded by conflict markers.
+func writeConflict(bf *bytes.Buffer, current, generated []string) {
+	bf.WriteString(conflictStart)
+	writeLines(bf, current)
+	terminateLine(bf)
+	bf.WriteString(conflictMiddle)
+	writeLines(bf, generated)
+	terminateLine(bf)
+	bf.WriteString(conflictEnd)
+}
+
+func writeLines(bf *bytes.Buffer, lines []string) {
+	for _, l := range lines {
+		bf.WriteString(l)
+	}
+}
+
+// terminateLine adds a linefeed if bf does not end with one (needed before conflict markers).
+func terminateLine(bf *bytes.Buffer) {
+	if b := bf.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+		bf.WriteByte('\n')
+	}
+}
+
+// merge3 merges the changes between base and current and between base and generated.
+// Lines that were changed differently on both sides are surrounded by conflict markers.
+// It returns the merged content and the number of conflicts.
+func merge3(base, current, generated []byte) (merged []byte, conflicts int) {
+	b, c, g := splitLines(base), splitLines(current), splitLines(generated)
+	mc, mg := matchLines(b, c), matchLines(b, g)
+
+	var bf bytes.Buffer
+	var i, ci, gi int
+
+	resolve := func(bEnd, cEnd, gEnd int) {
+		bChunk, cChunk, gChunk := b[i:bEnd], c[ci:cEnd], g[gi:gEnd]
+		switch {
+		case equalLines(cChunk, bChunk):
+			writeLines(&bf, gChunk)
+		case equalLines(gChunk, bChunk), equalLines(cChunk, gChunk):
+			writeLines(&bf, cChunk)
+		default:
+			writeConflict(&bf, cChunk, gChunk)
+			conflicts++
+		}
+	}
+
+	for j := range b {
+		// only lines that are unchanged in current and generated are stable anchors
+		if mc[j] < ci || mg[j] < gi {
+			continue
+		}
+		resolve(j, mc[j], mg[j])
+		bf.WriteString(b[j])
+		i, ci, gi = j+1, mc[j]+1, mg[j]+1
+	}
+	resolve(len(b), len(c), len(g))
+
+	return bf.Bytes(), conflicts
+}
+
+// merge2 is used instead of merge3 if there is no base. Every difference between
+// current and generated is treated as a conflict.
+func merge2(current, generated []byte) (merged []byte, conflicts int) {
+	c, g := splitLines(current), splitLines(generated)
+	m := matchLines(c, g)
+
+	var bf bytes.Buffer
+	var ci, gi int
+
+	resolve := func(cEnd, gEnd int) {
+		if cEnd > ci || gEnd > gi {
+			writeConflict(&bf, c[ci:cEnd], g[gi:gEnd])
+			conflicts++
+		}
+	}
+
+	for j := range c {
+		if m[j] < gi {
+			continue
+		}
+		resolve(j, m[j])
+		bf.WriteString(c[j])
+		ci, gi = j+1, m[j]+1
+	}
+	resolve(len(c), len(g))
+
+	return bf.Bytes(), conflicts
+}
+
+// mergeAction returns the action that is reported for a merge with the given number of conflicts
+func mergeAction(conflicts int) string {
+	if conflicts == 0 {
+		return actionMerged
+	}
+	return fmt.Sprintf("%s with %d conflicts", actionMerged, conflicts)
+}
@@ -0,0 +1,127 @@
+package scaffold
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UnsafePathError is returned if the rendered name of a context leads to a path outside of the BaseDir,
+// either directly (e.g. via ../) or through a symlink inside the target tree.
+type UnsafePathError struct {
+
+	// Pos is the position of the line that opened the file context
+	Pos Position
+
+	// Path is the path of the file that would have been written
+	Path string
+
+	// Resolved is the path after resolving the symlinks
+	Resolved string
+
+	// Asset is true if Path is the source of an asset context, which must be beneath the AssetDir
+	Asset bool
+}
+
+func (u *UnsafePathError) Error() string {
+	dir := "base"
+	if u.Asset {
+		dir = "asset"
+	}
+	msg := fmt.Sprintf("unsafe path at %s: %#v is outside of the %s directory", u.Pos, u.Path, dir)
+	if u.Resolved != "" {
+		msg += fmt.Sprintf(" (resolves to %#v)", u.Resolved)
+	}
+	return msg
+}
+
+// checkPath checks, if the file is beneath the BaseDir, after the symlinks that already exist
+// are resolved. Nothing is checked if the Generator is Unsafe.
+func (g *Generator) checkPath(file string, pos Position) error {
+	if g.Unsafe {
+		return nil
+	}
+	return checkBeneath(g.BaseDir, file, pos)
+}
+
+// checkAsset checks, if the source file of an asset context is beneath the AssetDir, after the
+// symlinks are resolved, so that the rendered attribute can't copy arbitrary files.
+// Nothing is checked if the Generator is Unsafe.
+func (g *Generator) checkAsset(file string, pos Position) error {
+	if g.Unsafe {
+		return nil
+	}
+	err := checkBeneath(g.AssetDir, file, pos)
+	if u, is := err.(*UnsafePathError); is {
+		u.Asset = true
+	}
+	return err
+}
+
+// checkBeneath returns an UnsafePathError if the file is not beneath dir, after the symlinks that
+// already exist are resolved.
+func checkBeneath(dir, file string, pos Position) error {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	if !isBeneath(base, target) {
+		return &UnsafePathError{Pos: pos, Path: file}
+	}
+
+	realBase, err := resolvePath(base)
+	if err != nil {
+		return err
+	}
+	realTarget, err := resolvePath(target)
+	if err != nil {
+		return err
+	}
+
+	if !isBeneath(realBase, realTarget) {
+		return &UnsafePathError{Pos: pos, Path: file, Resolved: realTarget}
+	}
+	return nil
+}
+
+// isBeneath checks if the cleaned absolute path is equal to or beneath the cleaned absolute dir
+func isBeneath(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath resolves the symlinks of the absolute path. Since the path may not exist (yet),
+// the symlinks of the deepest existing ancestor are resolved and the missing parts are appended.
+func resolvePath(path string) (string, error) {
+	var missing []string
+	for {
+		_, err := os.Lstat(path)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		missing = append([]string{filepath.Base(path)}, missing...)
+		path = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{resolved}, missing...)...), nil
+}
@@ -0,0 +1,218 @@
+package scaffold
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the actions of a Change
+const (
+	ActionCreate    = "create"
+	ActionModify    = "modify"
+	ActionUnchanged = "unchanged"
+	ActionSkip      = "skip"
+)
+
+// Change describes what a run does with a file or directory.
+type Change struct {
+
+	// Path is the slash separated path relative to the base directory
+	Path string `json:"path"`
+
+	// Dir is true for directories
+	Dir bool `json:"dir,omitempty"`
+
+	// Action is one of ActionCreate, ActionModify, ActionUnchanged and ActionSkip
+	Action string `json:"action"`
+
+	// Diff is the unified diff between the current and the new content for ActionModify
+	Diff string `json:"diff,omitempty"`
+
+	// Link is the target of symlinks
+	Link string `json:"link,omitempty"`
+}
+
+// Plan is the list of changes of a run, in the order they happen.
+type Plan []Change
+
+// String returns the plan in a human readable format.
+func (p Plan) String() string {
+	var bf bytes.Buffer
+	for _, c := range p {
+		path := c.Path
+		if c.Dir {
+			path += "/"
+		}
+		if c.Link != "" {
+			path += " -> " + c.Link
+		}
+		fmt.Fprintf(&bf, "%-10s %s\n", c.Action, path)
+		bf.WriteString(c.Diff)
+	}
+	return bf.String()
+}
+
+// Plan returns the changes that the Run method would make for the given body
+// without creating any files and directories.
+func (g *Generator) Plan(body string) (Plan, error) {
+	p := *g
+	p.DryRun = true
+	p.plan = &Plan{}
+	p.planned = map[string]bool{}
+	err := p.Run(body)
+	return *p.plan, err
+}
+
+// planDirs adds the directories between g.BaseDir and the given dir to the plan
+func (g *Generator) planDirs(dir string) {
+	rel, err := filepath.Rel(g.BaseDir, dir)
+	if err != nil || rel == "." {
+		return
+	}
+
+	var path string
+	for _, d := range strings.Split(filepath.ToSlash(rel), "/") {
+		path += d
+		if !g.planned[path] {
+			g.planned[path] = true
+			action := ActionUnchanged
+			if _, err := os.Stat(filepath.Join(g.BaseDir, path)); os.IsNotExist(err) {
+				action = ActionCreate
+			}
+			*g.plan = append(*g.plan, Change{Path: path, Dir: true, Action: action})
+		}
+		path += "/"
+	}
+}
+
+// planFile adds the file to the plan. action is the action returned by resolveConflict or inject.
+// The content is compared to the content of the file after the already prepared files have been written.
+func (g *Generator) planFile(file string, action string, content []byte, prepared []*pendingFile) error {
+	// skipped files do not create directories
+	if action != actionSkipped {
+		g.planDirs(filepath.Dir(file))
+	}
+
+	rel, err := filepath.Rel(g.BaseDir, file)
+	if err != nil {
+		return err
+	}
+	c := Change{Path: filepath.ToSlash(rel)}
+
+	switch action {
+	case "":
+		c.Action = ActionCreate
+	case actionSkipped:
+		c.Action = ActionSkip
+	default:
+		current, _, err := currentContent(file, prepared)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(current, content) {
+			c.Action = ActionUnchanged
+		} else {
+			c.Action = ActionModify
+			c.Diff = unifiedDiff(c.Path, current, content)
+		}
+	}
+
+	*g.plan = append(*g.plan, c)
+	return nil
+}
+
+// the number of unchanged lines that surround the changes in a unified diff
+const diffContext = 3
+
+// diffLine is a line of a diff
+type diffLine struct {
+	op     byte // one of ' ', '-' and '+'
+	line   string
+	ai, bi int // the number of lines of the old and the new content before the line
+}
+
+// unifiedDiff returns the unified diff between old and new content of the file with the given path.
+func unifiedDiff(path string, old, new []byte) string {
+	a, b := splitLines(old), splitLines(new)
+	m := matchLines(a, b)
+
+	var lines []diffLine
+	var ai, bi int
+	for ai < len(a) || bi < len(b) {
+		switch {
+		case ai < len(a) && m[ai] == -1:
+			lines = append(lines, diffLine{'-', a[ai], ai, bi})
+			ai++
+		case ai < len(a) && m[ai] == bi:
+			lines = append(lines, diffLine{' ', a[ai], ai, bi})
+			ai++
+			bi++
+		default:
+			lines = append(lines, diffLine{'+', b[bi], ai, bi})
+			bi++
+		}
+	}
+
+	var bf bytes.Buffer
+	fmt.Fprintf(&bf, "--- a/%s\n+++ b/%s\n", path, path)
+
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			i++
+			continue
+		}
+
+		// changes that are separated by not more than 2*diffContext unchanged lines
+		// are part of the same hunk
+		last := i
+		for j := i + 1; j < len(lines) && j-last <= 2*diffContext+1; j++ {
+			if lines[j].op != ' ' {
+				last = j
+			}
+		}
+
+		start, end := i-diffContext, last+1+diffContext
+		if start < 0 {
+			start = 0
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		var aLen, bLen int
+		for _, l := range lines[start:end] {
+			if l.op != '+' {
+				aLen++
+			}
+			if l.op != '-' {
+				bLen++
+			}
+		}
+
+		fmt.Fprintf(&bf, "@@ -%s +%s @@\n", hunkRange(lines[start].ai, aLen), hunkRange(lines[start].bi, bLen))
+		for _, l := range lines[start:end] {
+			bf.WriteByte(l.op)
+			bf.WriteString(l.line)
+			if !strings.HasSuffix(l.line, "\n") {
+				bf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+
+	return bf.String()
+}
+
+// hunkRange returns the range of a hunk header, start is the zero based line before the hunk
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
@@ -0,0 +1,249 @@
+package scaffold
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exampleObject is a json object that keeps the order of its keys
+type exampleObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// parseExample parses the json example inside the head of a template.
+// Objects are returned as *exampleObject to keep the order of the keys.
+// Properties of the outermost object that start with $ (like $defaults) are not part of the example.
+func parseExample(head string) (example interface{}, err error) {
+	dec := json.NewDecoder(strings.NewReader(head))
+	dec.UseNumber()
+	example, err = decodeExample(dec)
+	if err != nil {
+		return nil, fmt.Errorf("head is not a json example: %s", err)
+	}
+
+	if obj, is := example.(*exampleObject); is {
+		var keys []string
+		for _, k := range obj.keys {
+			if strings.HasPrefix(k, "$") {
+				delete(obj.values, k)
+				continue
+			}
+			keys = append(keys, k)
+		}
+		obj.keys = keys
+	}
+	return example, nil
+}
+
+func decodeExample(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := &exampleObject{values: map[string]interface{}{}}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			val, err := decodeExample(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.keys = append(obj.keys, key.(string))
+			obj.values[key.(string)] = val
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		var arr []interface{}
+		for dec.More() {
+			val, err := decodeExample(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+		}
+		_, err = dec.Token()
+		return arr, err
+	default:
+		return tok, nil
+	}
+}
+
+// example returns an example for the schema that can be used for prompting.
+// The properties of objects are sorted by name. Default values are used as examples.
+func (s *Schema) example() interface{} {
+	switch def := s.Default.(type) {
+	case string, bool:
+		return def
+	case float64:
+		return json.Number(strconv.FormatFloat(def, 'f', -1, 64))
+	}
+
+	switch typ := s.Type.main(); {
+	case typ == "object" || s.Properties != nil:
+		obj := &exampleObject{values: map[string]interface{}{}}
+		for k := range s.Properties {
+			obj.keys = append(obj.keys, k)
+		}
+		sort.Strings(obj.keys)
+		for _, k := range obj.keys {
+			obj.values[k] = s.Properties[k].example()
+		}
+		return obj
+	case typ == "array":
+		if s.Items == nil {
+			return []interface{}{""}
+		}
+		return []interface{}{s.Items.example()}
+	case typ == "boolean":
+		return false
+	case typ == "number" || typ == "integer":
+		return json.Number("0")
+	default:
+		return ""
+	}
+}
+
+// prompter asks for the values of the placeholders
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p *prompter) readLine(question string) (string, error) {
+	fmt.Fprint(p.out, question)
+	line, err := p.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	return strings.TrimSpace(line), err
+}
+
+func (p *prompter) confirm(question string) (bool, error) {
+	for {
+		answer, err := p.readLine(question + " [y/N] ")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true, nil
+		case "", "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// ask asks for the value at the given path, based on the given example
+func (p *prompter) ask(path string, example interface{}) (interface{}, error) {
+	switch ex := example.(type) {
+	case *exampleObject:
+		obj := map[string]interface{}{}
+		for _, k := range ex.keys {
+			val, err := p.ask(strings.TrimPrefix(path+"."+k, "."), ex.values[k])
+			if err != nil {
+				return nil, err
+			}
+			obj[k] = val
+		}
+		return obj, nil
+	case []interface{}:
+		var item interface{} = ""
+		if len(ex) > 0 {
+			item = ex[0]
+		}
+		arr := []interface{}{}
+		for {
+			ok, err := p.confirm(fmt.Sprintf("add an entry to %s?", path))
+			if err != nil || !ok {
+				return arr, err
+			}
+			val, err := p.ask(fmt.Sprintf("%s[%d]", path, len(arr)), item)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+		}
+	case bool:
+		return p.confirm(path + "?")
+	case json.Number:
+		for {
+			answer, err := p.readLine(question(path, ex.String()))
+			if err != nil {
+				return nil, err
+			}
+			if answer == "" {
+				answer = ex.String()
+			}
+			if f, err := strconv.ParseFloat(answer, 64); err == nil {
+				return f, nil
+			}
+			fmt.Fprintf(p.out, "%#v is not a number\n", answer)
+		}
+	case nil:
+		return nil, nil
+	default:
+		def := fmt.Sprint(ex)
+		answer, err := p.readLine(question(path, def))
+		if answer == "" {
+			answer = def
+		}
+		return answer, err
+	}
+}
+
+func question(path, def string) string {
+	if def == "" {
+		return path + ": "
+	}
+	return fmt.Sprintf("%s [%s]: ", path, def)
+}
+
+// Prompt asks for the values of the placeholders as described by the given head of a template.
+// The head must either be a json example or a schema (see ParseSchema).
+// The questions are written to out and the answers are read line by line from in.
+// Non empty values of the example are used as defaults.
+// For arrays, the first entry of the example describes the entries, that are asked for, until the
+// user declines to add another entry.
+func Prompt(head string, in io.Reader, out io.Writer) (map[string]interface{}, error) {
+	var example interface{}
+
+	schema, err := ParseSchema(head)
+	if err != nil {
+		return nil, err
+	}
+
+	if schema != nil {
+		example = schema.example()
+	} else {
+		example, err = parseExample(head)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, is := example.(*exampleObject); !is {
+		return nil, fmt.Errorf("head is not a json object")
+	}
+
+	p := &prompter{in: bufio.NewReader(in), out: out}
+	data, err := p.ask("", example)
+	if err != nil {
+		return nil, err
+	}
+	return data.(map[string]interface{}), nil
+}
@@ -4,12 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -93,107 +93,106 @@ func Replace(s, old, new string) string {
 	return strings.Replace(s, old, new, -1)
 }
 
-// writeFile creates the given file with the given content if isTest is true.
-// Needed directories are created on the fly and each file name is written to log
-// if log is not nil.
-// If isTest is true, no files and directories are created.
-func writeFile(file string, content []byte, log io.Writer, isTest bool) error {
-	dir := filepath.Dir(file)
-
-	if s, err := os.Stat(dir); err != nil || !s.IsDir() {
+// parseGenerator creates files and directories beneath g.BaseDir as defined in the reader.
+// The markers of the sourceMap are removed from the lines and used for the positions of errors.
+// The contents of the verbatim contexts are taken from verbatim (see extractVerbatim).
+// The files are only written after the whole body has been parsed without errors (see commit).
+// The file names are written to g.Log if it is not nil.
+// If g.DryRun is true, no files and directories are created.
+func (g *Generator) parseGenerator(rd io.Reader, sm *sourceMap, verbatim [][]byte) error {
+	br := bufio.NewReader(rd)
+	tr := sm.tracker()
+	var stack contextStack
+	var bf bytes.Buffer
+	var files []*pendingFile
+	for {
+		line, err := readLine(br)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			if os.IsNotExist(err) {
-				if !isTest {
-					err = os.MkdirAll(dir, 0770)
-				} else {
-					err = nil
-				}
-			}
-			if err != nil {
-				return err
-			}
-		} else {
-			return fmt.Errorf("not a directory: %#v", dir)
+			return err
 		}
-	}
-
-	if log != nil {
-		log.Write([]byte(file + "\n"))
-	}
+		s, pos := tr.strip(line)
+		name, opens, closes := contextLine(s)
 
-	if !isTest {
-		return ioutil.WriteFile(file, content, 0664)
-	}
-	return nil
-}
+		if name == "" && (opens || closes) {
+			return &SyntaxError{pos, "missing name of context"}
+		}
 
-// parseGenerator creates files and directories beneath baseDir as defined in the reader.
-// The file names are written to log if it is not nil.
-// If isTest is true, no files and directories are created.
-func parseGenerator(baseDir string, rd io.Reader, log io.Writer, isTest bool) error {
-	scanner := bufio.NewScanner(rd)
-	var file string
-	var dir = baseDir
-	var bf bytes.Buffer
-	var line = -1
-	for scanner.Scan() {
-		line++
-		s := scanner.Text()
-		if strings.HasPrefix(s, ">>>") {
-			fd := strings.TrimSpace(strings.TrimPrefix(s, ">>>"))
-			if fd[len(fd)-1] == '/' {
-				dir = filepath.Join(dir, fd)
-				file = ""
-			} else {
-				if file != "" {
-					return fmt.Errorf("syntax error in line %d embedding file within file is not allowed (%#v inside %#v)", line, fd, file)
-				}
-				file = filepath.Join(dir, fd)
+		if opens {
+			if err := stack.push(name, pos); err != nil {
+				return err
 			}
+			// text before a context is not part of the next file, so that the blank lines between
+			// the contexts of scanned templates don't end up in the generated files
+			bf.Reset()
 			continue
 		}
 
-		if strings.HasPrefix(s, "<<<") {
-			fd := strings.TrimSpace(strings.TrimPrefix(s, "<<<"))
-			if fd[len(fd)-1] == '/' {
-				dirName := filepath.Base(dir) + "/"
-				if dirName != fd {
-					return fmt.Errorf("syntax error in line %d closing dir %#v but should close dir %#v", line, fd, dirName)
-				}
-				dir = filepath.Dir(dir)
-			} else {
-				base := filepath.Base(file)
-				if base != fd {
-					return fmt.Errorf("syntax error in line %d closing file %#v but should close file %#v", line, fd, base)
+		if closes {
+			file, isFile := stack.file()
+			dir := stack.dir(g.BaseDir)
+			dirModes := stack.dirModes(g.BaseDir)
+			opened := stack.innermost()
+			if err := stack.pop(name, pos); err != nil {
+				return err
+			}
+			if isFile {
+				path := filepath.Join(dir, file)
+				var f *pendingFile
+				var err error
+				if opened.attrs.Link != "" {
+					if err = g.checkLink(path, opened.attrs.Link, opened.pos); err == nil {
+						f, err = g.prepareLink(path, bf.Bytes(), opened.attrs)
+					}
+				} else if err = g.checkPath(path, opened.pos); err == nil {
+					var content []byte
+					content, err = g.contentOf(opened, append([]byte(nil), bf.Bytes()...), verbatim)
+					if err == nil {
+						f, err = g.prepareFile(path, content, opened.attrs, opened.pos, files)
+					}
 				}
-				err := writeFile(file, bf.Bytes(), log, isTest)
 				if err != nil {
 					return err
 				}
-				file = ""
+				f.dirModes = dirModes
+				files = append(files, f)
 				bf.Reset()
 			}
 			continue
 		}
 
 		bf.WriteString(s + "\n")
-		// fmt.Println(scanner.Text()) // Println will add back the final '\n'
 	}
-	if err := scanner.Err(); err != nil {
-		return err
+	if errs := stack.unclosed(); len(errs) > 0 {
+		return errs
 	}
-	return nil
+	return g.commit(files)
 }
 
 // SplitTemplate splits the given template on the first empty line.
 // It returns the head and body of the template.
-// Templates must be UTF8 without byte order marker and have \n (linefeed) as line terminator.
+// Templates must be UTF8 without byte order marker and have \n (linefeed) or \r\n as line terminator.
 func SplitTemplate(template string) (head, body string) {
-	spl := strings.SplitN(template, "\n\n", 2)
-	if len(spl) != 2 {
+	idx := strings.Index(template, "\n\n")
+	if crlf := strings.Index(template, "\n\r\n"); crlf != -1 && (idx == -1 || crlf < idx) {
+		return strings.TrimSuffix(template[:crlf], "\r"), template[crlf+3:]
+	}
+	if idx == -1 {
 		return "", template
 	}
-	return spl[0], spl[1]
+	return template[:idx], template[idx+2:]
+}
+
+// readLine reads the next line without the trailing \n. Lines may have any length and carriage returns
+// are kept, so that \r\n line endings are kept. io.EOF is only returned if there is no line left.
+func readLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimSuffix(line, "\n"), err
 }
 
 // convertJSON converts json to a map
@@ -203,43 +202,104 @@ func convertJSON(rd io.Reader) (data map[string]interface{}, err error) {
 	return
 }
 
-// mix mixes the given data to the template body
-func mix(body string, data map[string]interface{}) (rd io.Reader, err error) {
+// templateName is the name of the template if the Generator has no Name
+const templateName = "x"
+
+// mix mixes the given data to the template body. The functions of g.FuncMap are available
+// in addition to the FuncMap. Errors refer to the lines of the template file (see Generator.LineOffset).
+// The rendered body contains markers for the returned sourceMap.
+func (g *Generator) mix(body string, data map[string]interface{}) (rd io.Reader, sm *sourceMap, err error) {
 	var bf bytes.Buffer
-	t := template.New("x").Funcs(FuncMap)
+	name := g.templateName()
+	t := template.New(name).Funcs(FuncMap).Funcs(g.FuncMap)
+	if g.Strict {
+		t = t.Option("missingkey=error")
+	}
 	t, err = t.Parse(body)
 	if err != nil {
-		return
+		return nil, nil, g.templateError(name, err)
 	}
+	sm = newSourceMap(name, g.LineOffset, body)
+	sm.sources = g.Sources
+	sm.instrument(t)
 	err = t.Execute(&bf, data)
-	rd = &bf
-	return
+	if err != nil {
+		err = g.templateError(name, err)
+		// the markers of the partial output tell in which iterations the error happened
+		_, pos := sm.tracker().strip(bf.String())
+		if its := pos.iterations(); its != "" {
+			err = fmt.Errorf("%s (%s)", err, its)
+		}
+		return nil, nil, err
+	}
+	return &bf, sm, nil
+}
+
+func (g *Generator) templateName() string {
+	if g.Name == "" {
+		return templateName
+	}
+	return g.Name
+}
+
+// templateError translates the line numbers of the body inside the error message of the
+// text/template package to line numbers of the template file or - if the body was read from a template
+// directory - to the files inside it. Errors inside the names of files have no line number.
+func (g *Generator) templateError(name string, err error) error {
+	if g.LineOffset == 0 && g.Sources == nil {
+		return err
+	}
+	re := regexp.MustCompile(`template: ` + regexp.QuoteMeta(name) + `:(\d+)(:\d+)?`)
+	msg := re.ReplaceAllStringFunc(err.Error(), func(s string) string {
+		m := re.FindStringSubmatch(s)
+		line, _ := strconv.Atoi(m[1])
+		if g.Sources == nil {
+			return "template: " + name + ":" + strconv.Itoa(line+g.LineOffset) + m[2]
+		}
+		file, fileLine := g.Sources.position(line)
+		switch {
+		case file == "":
+			return s
+		case fileLine == 0:
+			return "template: " + file
+		default:
+			return "template: " + file + ":" + strconv.Itoa(fileLine) + m[2]
+		}
+	})
+	return errors.New(msg)
+}
+
+// BodyOffset returns the number of lines of the template that precede the body
+// as returned by SplitTemplate.
+func BodyOffset(template string) int {
+	_, body := SplitTemplate(template)
+	return strings.Count(template[:len(template)-len(body)], "\n")
 }
 
 // Run mixes the properties of the json object to the template body. The result is then used
 // to create files and directories beneath baseDir.
 // If isTest is true the files and directories are not really created.
 // If log is not nil a list of files that will be created is written to log.
-func Run(baseDir string, body string, json io.Reader, log io.Writer, isTest bool) error {
+// The handling of already existing files can be configured via opts (see OnConflict).
+//
+// Run is a shortcut for the Run method of a Generator. Use the Generator for
+// more settings.
+func Run(baseDir string, body string, json io.Reader, log io.Writer, isTest bool, opts ...RunOption) error {
+	placeholders, err := convertJSON(json)
+	if err != nil {
+		return err
+	}
 
-	var (
-		err          error
-		placeholders map[string]interface{}
-		generator    io.Reader
-	)
+	g := &Generator{
+		BaseDir: baseDir,
+		Data:    placeholders,
+		Log:     log,
+		DryRun:  isTest,
+	}
 
-steps:
-	for jump := 1; err == nil; jump++ {
-		switch jump - 1 {
-		default:
-			break steps
-		case 0:
-			placeholders, err = convertJSON(json)
-		case 1:
-			generator, err = mix(body, placeholders)
-		case 2:
-			err = parseGenerator(baseDir, generator, log, isTest)
-		}
+	for _, opt := range opts {
+		opt(g)
 	}
-	return err
+
+	return g.Run(body)
 }
@@ -2,6 +2,11 @@ package scaffold
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -310,3 +315,1470 @@ func TestRunErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestRunConflict(t *testing.T) {
+
+	tests := []struct {
+		policy      ConflictPolicy
+		confirm     bool
+		expectedLog string
+		content     string
+		backup      string
+	}{
+		{ConflictOverwrite, false, "file.txt (overwritten)\n", "new\n", ""},
+		{ConflictSkip, false, "file.txt (skipped)\n", "old", ""},
+		{ConflictBackup, false, "file.txt (backup: file.txt.bak)\n", "new\n", "old"},
+		{ConflictPrompt, true, "file.txt (overwritten)\n", "new\n", ""},
+		{ConflictPrompt, false, "file.txt (skipped)\n", "old", ""},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "file.txt")
+		if err := ioutil.WriteFile(file, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var log bytes.Buffer
+		confirm := func(string) (bool, error) { return test.confirm, nil }
+		err := Run(dir, ">>>file.txt\nnew\n<<<file.txt", strings.NewReader(`{}`), &log, false, OnConflict(test.policy), Confirm(confirm))
+		if err != nil {
+			t.Errorf("Run(..., OnConflict(%s)) returned error: %v", test.policy, err)
+			continue
+		}
+
+		if got, want := strings.Replace(log.String(), dir+string(filepath.Separator), "", -1), test.expectedLog; got != want {
+			t.Errorf("Run(..., OnConflict(%s)) logged %#v; want %#v", test.policy, got, want)
+		}
+
+		content, _ := ioutil.ReadFile(file)
+		if got, want := string(content), test.content; got != want {
+			t.Errorf("Run(..., OnConflict(%s)) wrote %#v; want %#v", test.policy, got, want)
+		}
+
+		if test.backup != "" {
+			backup, _ := ioutil.ReadFile(file + ".bak")
+			if got, want := string(backup), test.backup; got != want {
+				t.Errorf("Run(..., OnConflict(%s)) backup is %#v; want %#v", test.policy, got, want)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("old"), 0644)
+	err := Run(dir, ">>>file.txt\nnew\n<<<file.txt", strings.NewReader(`{}`), nil, false, OnConflict(ConflictFail))
+	if _, is := err.(ErrFileExists); !is {
+		t.Errorf("Run(..., OnConflict(fail)) returned %v; want ErrFileExists", err)
+	}
+
+	// a file that is written twice by the same run is backed up once
+	dir = t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(file, []byte("old"), 0644)
+	var log bytes.Buffer
+	body := "{{range .L}}>>>file.txt\n{{.}}\n<<<file.txt\n{{end}}"
+	err = Run(dir, body, strings.NewReader(`{"L": ["1", "2"]}`), &log, false, OnConflict(ConflictBackup))
+	if err != nil {
+		t.Fatalf("Run(..., OnConflict(backup)) returned error: %v", err)
+	}
+	if got, want := strings.Replace(log.String(), dir+string(filepath.Separator), "", -1), "file.txt (backup: file.txt.bak)\nfile.txt (overwritten)\n"; got != want {
+		t.Errorf("Run(..., OnConflict(backup)) logged %#v; want %#v", got, want)
+	}
+	for name, want := range map[string]string{"file.txt": "2\n", "file.txt.bak": "old"} {
+		content, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		if got := string(content); got != want {
+			t.Errorf("Run(..., OnConflict(backup)) wrote %#v to %s; want %#v", got, name, want)
+		}
+	}
+	if _, err := os.Stat(file + ".bak.1"); !os.IsNotExist(err) {
+		t.Errorf("Run(..., OnConflict(backup)) created a second backup")
+	}
+}
+
+func TestMerge3(t *testing.T) {
+
+	tests := []struct {
+		base, current, generated, expected string
+		conflicts                          int
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", "a\nB\nc\n", "a\nB\nc\n", 0},
+		{"a\nb\nc\n", "a\nb\nc\nd\n", "a\nB\nc\n", "a\nB\nc\nd\n", 0},
+		{"a\nb\nc\n", "x\na\nb\nc\n", "a\nb\nc\ny\n", "x\na\nb\nc\ny\n", 0},
+		{"a\nb\nc\n", "a\nX\nc\n", "a\nX\nc\n", "a\nX\nc\n", 0},
+		{"a\nb\nc\n", "a\nX\nc\n", "a\nY\nc\n", "a\n<<<<<<< current\nX\n=======\nY\n>>>>>>> generated\nc\n", 1},
+		{"a\nb", "a\nb", "a\nc", "a\nc", 0},
+	}
+
+	for _, test := range tests {
+		merged, conflicts := merge3([]byte(test.base), []byte(test.current), []byte(test.generated))
+		if got, want := string(merged), test.expected; got != want || conflicts != test.conflicts {
+			t.Errorf("merge3(%#v, %#v, %#v) = %#v, %d; want %#v, %d", test.base, test.current, test.generated, got, conflicts, want, test.conflicts)
+		}
+	}
+}
+
+func TestRunMerge(t *testing.T) {
+	dir := t.TempDir()
+	body := ">>>file.txt\n{{range .Lines}}{{.}}\n{{end}}<<<file.txt"
+	file := filepath.Join(dir, "file.txt")
+
+	run := func(json string) string {
+		var log bytes.Buffer
+		err := Run(dir, body, strings.NewReader(json), &log, false, OnConflict(ConflictMerge))
+		if err != nil {
+			t.Fatalf("Run(..., OnConflict(merge)) returned error: %v", err)
+		}
+		return strings.Replace(log.String(), dir+string(filepath.Separator), "", -1)
+	}
+
+	run(`{"Lines": ["a", "b", "c"]}`)
+
+	// the user edits the generated file
+	ioutil.WriteFile(file, []byte("a\nb\nc\nuser\n"), 0644)
+
+	if got, want := run(`{"Lines": ["A", "b", "c"]}`), "file.txt (merged)\n"; got != want {
+		t.Errorf("logged %#v; want %#v", got, want)
+	}
+
+	content, _ := ioutil.ReadFile(file)
+	if got, want := string(content), "A\nb\nc\nuser\n"; got != want {
+		t.Errorf("merged content is %#v; want %#v", got, want)
+	}
+
+	if got, want := run(`{"Lines": ["A", "b", "c"]}`), "file.txt (unchanged)\n"; got != want {
+		t.Errorf("logged %#v; want %#v", got, want)
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	dir := t.TempDir()
+	var log bytes.Buffer
+	var written []string
+
+	g := &Generator{
+		BaseDir: dir,
+		Data:    map[string]interface{}{"Name": "world"},
+		FuncMap: map[string]interface{}{"greet": func(s string) string { return "hello " + s }},
+		Log:     &log,
+		Hooks: Hooks{
+			BeforeWrite: func(file string, content []byte) ([]byte, error) {
+				return bytes.ToUpper(content), nil
+			},
+			AfterWrite: func(file string) error {
+				written = append(written, filepath.Base(file))
+				return nil
+			},
+		},
+	}
+
+	err := g.Run(">>>a/\n>>>file.txt\n{{greet .Name}}\n<<<file.txt\n<<<a/\n")
+	if err != nil {
+		t.Fatalf("Generator.Run returned error: %v", err)
+	}
+
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "a", "file.txt"))
+	if got, want := string(content), "HELLO WORLD\n"; got != want {
+		t.Errorf("Generator.Run wrote %#v; want %#v", got, want)
+	}
+
+	if got, want := strings.Join(written, ","), "file.txt"; got != want {
+		t.Errorf("AfterWrite called with %#v; want %#v", got, want)
+	}
+
+	info, _ := os.Stat(filepath.Join(dir, "a", "file.txt"))
+	if got, want := info.Mode().Perm(), DefaultFileMode&^umask(); got != want {
+		t.Errorf("file mode is %v; want %v", got, want)
+	}
+}
+
+// umask returns the current umask of the process
+func umask() os.FileMode {
+	dir, err := ioutil.TempDir("", "umask")
+	if err != nil {
+		return 0
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "f")
+	ioutil.WriteFile(file, nil, 0777)
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+	return 0777 &^ info.Mode().Perm()
+}
+
+func TestModes(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.sh")
+	ioutil.WriteFile(existing, []byte("old\n"), 0644)
+
+	g := &Generator{BaseDir: dir, FileMode: 0600, DirMode: 0700}
+	err := g.Run(">>>bin/ mode=0751\n>>>run.sh mode=0755\nrun\n<<<run.sh\n>>>conf\nconf\n<<<conf\n<<<bin/\n>>>existing.sh  mode=0750\nnew\n<<<existing.sh\n")
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	modes := []struct {
+		path string
+		mode os.FileMode
+	}{
+		{"bin", 0751},
+		{"bin/run.sh", 0755},
+		{"bin/conf", 0600 &^ umask()},
+		{"existing.sh", 0750},
+	}
+
+	for _, m := range modes {
+		info, err := os.Stat(filepath.Join(dir, m.path))
+		if err != nil {
+			t.Errorf("%s is missing: %v", m.path, err)
+			continue
+		}
+		if got := info.Mode().Perm(); got != m.mode {
+			t.Errorf("mode of %s is %v; want %v", m.path, got, m.mode)
+		}
+	}
+
+	err = g.Run(">>>a.txt mode=0999\n<<<a.txt\n")
+	if got, want := fmt.Sprint(err), `syntax error at x:1: invalid mode "0999" of file "a.txt"`; got != want {
+		t.Errorf("Run with invalid mode returned %#v; want %#v", got, want)
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	tests := []struct {
+		line     string
+		name     string
+		attrs    string
+		expected string
+	}{
+		{"a.txt", "a.txt", "", ""},
+		{" my file.txt ", "my file.txt", "", ""},
+		{"run.sh mode=0755", "run.sh", "mode=0755", ""},
+		{"run.sh ifmissing  mode=755", "run.sh", "mode=0755 ifmissing", ""},
+		{"bin/ mode=0700", "bin/", "mode=0700", ""},
+		{"ifmissing", "ifmissing", "", ""},
+		{"a.txt foo=bar", "a.txt", "", `unknown attribute "foo"`},
+		{"a.txt ifmissing=true", "a.txt", "", `unknown attribute "ifmissing"`},
+		{"a.txt mode=0644 mode=0600", "a.txt", "", `duplicate attribute "mode"`},
+		{"a.txt mode=rwx", "a.txt", "", `invalid mode "rwx"`},
+		{"a/ ifmissing", "a/", "", `attribute "ifmissing" is not allowed for dirs`},
+	}
+
+	for _, test := range tests {
+		name, attrs, err := ParseAttributes(test.line)
+		var got string
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.expected || name != test.name || attrs.String() != test.attrs {
+			t.Errorf("ParseAttributes(%#v) = %#v, %#v, %#v; want %#v, %#v, %#v", test.line, name, attrs.String(), got, test.name, test.attrs, test.expected)
+		}
+	}
+}
+
+func TestIfMissing(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte("custom\n"), 0644)
+
+	var log bytes.Buffer
+	g := &Generator{BaseDir: dir, OnConflict: ConflictFail, Log: &log}
+	err := g.Run(">>>config.json ifmissing\ndefault\n<<<config.json\n>>>new.json ifmissing\ndefault\n<<<new.json\n")
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	for file, want := range map[string]string{"config.json": "custom\n", "new.json": "default\n"} {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, file)); string(got) != want {
+			t.Errorf("%s contains %#v; want %#v", file, string(got), want)
+		}
+	}
+
+	want := filepath.Join(dir, "config.json") + " (skipped)\n" + filepath.Join(dir, "new.json") + "\n"
+	if got := log.String(); got != want {
+		t.Errorf("log is %#v; want %#v", got, want)
+	}
+}
+
+func TestInject(t *testing.T) {
+	dir := t.TempDir()
+	routes := filepath.Join(dir, "routes.go")
+	ioutil.WriteFile(routes, []byte("func routes() {\n\t// scaffold:insert routes\n}\n\n// scaffold:insert routesX\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "all.txt"), []byte("a"), 0644)
+
+	var log bytes.Buffer
+	g := &Generator{BaseDir: dir, OnConflict: ConflictFail, Log: &log, Data: map[string]interface{}{"Models": []interface{}{"user", "post"}}}
+	body := `{{range .Models}}>>>routes.go insert=routes
+	route("{{.}}")
+<<<routes.go
+>>>all.txt append
+{{.}}
+<<<all.txt
+>>>new.txt append
+{{.}}
+<<<new.txt
+{{end}}
+`
+	if err := g.Run(body); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	expected := map[string]string{
+		"routes.go": "func routes() {\n\troute(\"user\")\n\troute(\"post\")\n\t// scaffold:insert routes\n}\n\n// scaffold:insert routesX\n",
+		"all.txt":   "a\nuser\npost\n",
+		"new.txt":   "user\npost\n",
+	}
+	for file, want := range expected {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, file)); string(got) != want {
+			t.Errorf("%s contains %#v; want %#v", file, string(got), want)
+		}
+	}
+
+	if got, want := log.String(), strings.Join([]string{
+		routes + " (inserted)",
+		filepath.Join(dir, "all.txt") + " (appended)",
+		filepath.Join(dir, "new.txt"),
+	}, "\n"); !strings.HasPrefix(got, want) {
+		t.Errorf("log is %#v; want prefix %#v", got, want)
+	}
+
+	errors := []struct {
+		body     string
+		expected string
+	}{
+		{">>>routes.go insert=models\nx\n<<<routes.go\n", `can't insert into "` + routes + `": missing marker "scaffold:insert models"`},
+		{">>>missing.go insert=routes\nx\n<<<missing.go\n", `can't insert into "` + filepath.Join(dir, "missing.go") + `": file does not exist`},
+		{">>>a.go append insert=routes\nx\n<<<a.go\n", `syntax error at x:1: can't combine attributes "append" and "insert" of file "a.go"`},
+	}
+
+	for _, test := range errors {
+		err := (&Generator{BaseDir: dir}).Run(test.body)
+		if got := fmt.Sprint(err); got != test.expected {
+			t.Errorf("Run(%#v) returned %#v; want %#v", test.body, got, test.expected)
+		}
+	}
+
+	// the plan injects into files that are created by the same run
+	body = ">>>b.txt\nb\n<<<b.txt\n>>>b.txt append\nc\n<<<b.txt\n"
+	plan, err := (&Generator{BaseDir: dir}).Plan(body)
+	if err != nil {
+		t.Fatalf("Plan(%#v) returned error: %v", body, err)
+	}
+	if got, want := plan.String(), "create     b.txt\nmodify     b.txt\n--- a/b.txt\n+++ b/b.txt\n@@ -1 +1,2 @@\n b\n+c\n"; got != want {
+		t.Errorf("Plan(%#v) = %#v; want %#v", body, got, want)
+	}
+}
+
+func TestInjectIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	routes := filepath.Join(dir, "routes.go")
+	ioutil.WriteFile(routes, []byte("func routes() {\n\t// scaffold:insert routes\n}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "models.go"), []byte("var models = []Model{\n\tUser{}, // scaffold:insert models\n}\n"), 0644)
+
+	body := `{{range .Models}}>>>routes.go insert=routes
+	route("{{.}}")
+<<<routes.go
+>>>models.go insert=models key={{.}}{}
+	{{.}}{},
+<<<models.go
+>>>all.txt append
+{{.}}
+<<<all.txt
+{{end}}
+`
+	var log bytes.Buffer
+	run := func(models ...interface{}) {
+		log.Reset()
+		g := &Generator{BaseDir: dir, Log: &log, Data: map[string]interface{}{"Models": models}}
+		if err := g.Run(body); err != nil {
+			t.Fatalf("Run returned error: %v", err)
+		}
+	}
+
+	run("User", "Post")
+	run("User", "Post")
+
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		if !strings.HasSuffix(line, " (unchanged)") {
+			t.Errorf("second run logged %#v; want unchanged", line)
+		}
+	}
+
+	run("Post", "Comment")
+
+	expected := map[string]string{
+		"routes.go": "func routes() {\n\troute(\"User\")\n\troute(\"Post\")\n\troute(\"Comment\")\n\t// scaffold:insert routes\n}\n",
+		"models.go": "var models = []Model{\n\tPost{},\n\tComment{},\n\tUser{}, // scaffold:insert models\n}\n",
+		"all.txt":   "User\nPost\nComment\n",
+	}
+	for file, want := range expected {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, file)); string(got) != want {
+			t.Errorf("%s contains %#v; want %#v", file, string(got), want)
+		}
+	}
+
+	_, _, err := ParseAttributes("a.go key=x")
+	if got, want := fmt.Sprint(err), `attribute "key" requires "append" or "insert"`; got != want {
+		t.Errorf("ParseAttributes returned %#v; want %#v", got, want)
+	}
+}
+
+func TestInjectElsewhere(t *testing.T) {
+	tests := []struct {
+		existing string
+		body     string
+		expected string
+	}{
+		// the same lines elsewhere in the file don't count
+		{"func a() {\n\t// scaffold:insert x\n}\n", ">>>a.go insert=x\n}\n<<<a.go\n", "func a() {\n}\n\t// scaffold:insert x\n}\n"},
+		{"\tb()\n\nfunc a() {\n\t// scaffold:insert x\n}\n", ">>>a.go insert=x\n\tb()\n<<<a.go\n", "\tb()\n\nfunc a() {\n\tb()\n\t// scaffold:insert x\n}\n"},
+		{"func UserHandler() {}\n\nfunc routes() {\n\t// scaffold:insert x\n}\n", ">>>a.go insert=x key=UserHandler\n\troute(UserHandler)\n<<<a.go\n", "func UserHandler() {}\n\nfunc routes() {\n\troute(UserHandler)\n\t// scaffold:insert x\n}\n"},
+		{"b\n\na\n", ">>>a.go append\nb\n<<<a.go\n", "b\n\na\nb\n"},
+		{"func b() {\n}\n\nfunc a() {}\n", ">>>a.go append\n}\n<<<a.go\n", "func b() {\n}\n\nfunc a() {}\n}\n"},
+
+		// directly before the marker or at the end of the file it is already injected
+		{"func a() {\n\tb()\n\tc()\n\t// scaffold:insert x\n}\n", ">>>a.go insert=x\n\tb()\n<<<a.go\n", "func a() {\n\tb()\n\tc()\n\t// scaffold:insert x\n}\n"},
+		{"a\n\nb\nc\n\n", ">>>a.go append\n\nb\n\n<<<a.go\n", "a\n\nb\nc\n\n"},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "a.go")
+		ioutil.WriteFile(file, []byte(test.existing), 0644)
+		if err := (&Generator{BaseDir: dir}).Run(test.body); err != nil {
+			t.Fatalf("Run(%#v) returned error: %v", test.body, err)
+		}
+		if got, _ := ioutil.ReadFile(file); string(got) != test.expected {
+			t.Errorf("Run(%#v) on %#v wrote %#v; want %#v", test.body, test.existing, string(got), test.expected)
+		}
+	}
+}
+
+func TestSkipEmpty(t *testing.T) {
+	body := ">>>tests/\n>>>a_test.go skipempty\n{{if .WithTests}}test{{end}}\n  \n<<<a_test.go\n<<<tests/\n>>>empty.txt\n<<<empty.txt\n"
+
+	tests := []struct {
+		withTests bool
+		skipEmpty bool
+		files     string
+	}{
+		{true, false, ".,empty.txt,tests,tests/a_test.go"},
+		{false, false, ".,empty.txt"},
+		{false, true, "."},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		g := &Generator{BaseDir: dir, SkipEmpty: test.skipEmpty, Data: map[string]interface{}{"WithTests": test.withTests}}
+		if err := g.Run(body); err != nil {
+			t.Fatalf("Run returned error: %v", err)
+		}
+
+		var found []string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			rel, _ := filepath.Rel(dir, path)
+			found = append(found, filepath.ToSlash(rel))
+			return nil
+		})
+		if got := strings.Join(found, ","); got != test.files {
+			t.Errorf("WithTests %v, SkipEmpty %v created %#v; want %#v", test.withTests, test.skipEmpty, got, test.files)
+		}
+
+		plan, err := g.Plan(body)
+		if err != nil {
+			t.Fatalf("Plan returned error: %v", err)
+		}
+		for _, c := range plan {
+			if c.Action != ActionUnchanged && c.Action != ActionSkip {
+				t.Errorf("WithTests %v, SkipEmpty %v: plan after run contains %v %s", test.withTests, test.skipEmpty, c.Action, c.Path)
+			}
+		}
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	dir, _ := filepath.EvalSymlinks(t.TempDir())
+
+	body := ">>>shared/\n>>>config.json ifmissing\n{}\n<<<config.json\n<<<shared/\n{{range .Services}}>>>{{.}}/\n>>>config.json link=../shared/config.json\n<<<config.json\n<<<{{.}}/\n{{end}}"
+	data := map[string]interface{}{"Services": []interface{}{"api", "web"}}
+
+	var log bytes.Buffer
+	g := &Generator{BaseDir: dir, Data: data, Log: &log, OnConflict: ConflictFail}
+	if err := g.Run(body); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	for _, service := range []string{"api", "web"} {
+		link := filepath.Join(dir, service, "config.json")
+		if target, err := os.Readlink(link); err != nil || target != "../shared/config.json" {
+			t.Errorf("%s links to %#v (%v); want %#v", link, target, err, "../shared/config.json")
+		}
+	}
+
+	// running again leaves the links unchanged, even with ConflictFail
+	log.Reset()
+	if err := g.Run(body); err != nil {
+		t.Fatalf("second Run returned error: %v", err)
+	}
+	if got, want := strings.Count(log.String(), "(unchanged)"), 2; got != want || strings.Count(log.String(), "(skipped)") != 1 {
+		t.Errorf("second run logged %d unchanged links; want %d: %s", got, want, log.String())
+	}
+
+	errors := []struct {
+		body     string
+		expected string
+	}{
+		{">>>a link=../../etc/passwd\n<<<a\n", `unsafe path at x:1: "` + filepath.Join(dir, "a") + ` -> ` + filepath.Join(filepath.Dir(filepath.Dir(dir)), "etc", "passwd") + `" is outside of the base directory`},
+		{">>>a link=b\ncontent\n<<<a\n", `symlink "` + filepath.Join(dir, "a") + `" must not have content`},
+		{">>>a link=b mode=0644\n<<<a\n", `syntax error at x:1: can't combine attributes "link" and "mode" of file "a"`},
+		{">>>shared/config.json link=b\n<<<shared/config.json\n", `file already exists: "` + filepath.Join(dir, "shared", "config.json") + `"`},
+	}
+	for _, test := range errors {
+		err := (&Generator{BaseDir: dir, OnConflict: ConflictFail}).Run(test.body)
+		if got := fmt.Sprint(err); got != test.expected {
+			t.Errorf("Run(%#v) returned %#v; want %#v", test.body, got, test.expected)
+		}
+	}
+
+	scanned, err := Scan(filepath.Join(dir, "api"))
+	if err != nil {
+		t.Fatalf("Scan returned error: %v", err)
+	}
+	if got, want := string(scanned), "\n>>>api/\n\n>>>config.json link=../shared/config.json\n<<<config.json\n\n<<<api/\n"; got != want {
+		t.Errorf("Scan returned %#v; want %#v", got, want)
+	}
+}
+
+func TestBinaryAndVerbatim(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "project")
+	os.MkdirAll(filepath.Join(src, "img"), 0755)
+
+	files := map[string]string{
+		"img/logo.png":  "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR" + strings.Repeat("\xff\x00", 100),
+		"page.tmpl":     "<h1>{{.Title}}</h1>\n>>>not a context\n",
+		"latin1.txt":    "caf\xe9\n",
+		"templates.txt": "{{ broken\n",
+		"plain.txt":     "plain\n",
+		"empty.txt":     "",
+		"noeol.txt":     "no newline",
+		"crlf.txt":      "a\r\nb\r\n",
+		"crlfnoeol.txt": "{{a}}\r\nb",
+		"mixed.txt":     "a\r\nb\nc",
+		"closing.txt":   "{{.}}\n<<<closing.txt\n",
+		"cr.txt":        "a\r",
+		"crlfcr.txt":    "a\r\nb\r",
+		"crcrlf.txt":    "a\r\r\n",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(content), 0644)
+	}
+
+	check := func(label, dir string) {
+		for name, want := range files {
+			got, err := ioutil.ReadFile(filepath.Join(dir, "project", filepath.FromSlash(name)))
+			if err != nil || string(got) != want {
+				t.Errorf("[%s] %s contains %#v (%v); want %#v", label, name, string(got), err, want)
+			}
+		}
+	}
+
+	tmpl, err := Scan(src)
+	if err != nil {
+		t.Fatalf("Scan returned error: %v", err)
+	}
+	for _, attr := range []string{">>>logo.png binary\n", ">>>page.tmpl verbatim\n", ">>>templates.txt verbatim\n", ">>>latin1.txt binary\n", ">>>plain.txt\nplain\n<<<plain.txt\n", ">>>empty.txt\n<<<empty.txt\n",
+		">>>noeol.txt noeol\n", ">>>crlf.txt eol=crlf\na\nb\n<<<crlf.txt", ">>>crlfnoeol.txt verbatim eol=crlf noeol\n{{a}}\nb\n<<<", ">>>mixed.txt noeol\n",
+		">>>closing.txt binary\n", ">>>cr.txt noeol\na\r\n<<<", ">>>crlfcr.txt noeol\n", ">>>crcrlf.txt\n"} {
+		if !bytes.Contains(tmpl, []byte(attr)) {
+			t.Errorf("Scan result does not contain %#v:\n%s", attr, tmpl)
+		}
+	}
+
+	dir := t.TempDir()
+	if err := (&Generator{BaseDir: dir, Strict: true}).Run(string(tmpl)); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	check("base64", dir)
+
+	assets := t.TempDir()
+	tmpl, err = Scan(src, Assets(assets))
+	if err != nil {
+		t.Fatalf("Scan returned error: %v", err)
+	}
+	if !bytes.Contains(tmpl, []byte(">>>logo.png asset=img/logo.png\n<<<logo.png\n")) {
+		t.Errorf("Scan result does not contain asset context:\n%s", tmpl)
+	}
+
+	dir = t.TempDir()
+	if err := (&Generator{BaseDir: dir, AssetDir: assets}).Run(string(tmpl)); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	check("assets", dir)
+
+	// verbatim contexts keep the line numbers of errors
+	err = (&Generator{}).Run(">>>a.txt verbatim\n{{\n}}\n<<<a.txt\n{{.X\n")
+	if got, want := fmt.Sprint(err), "unclosed action started at x:5"; !strings.HasSuffix(got, want) {
+		t.Errorf("Run returned %#v; want suffix %#v", got, want)
+	}
+
+	// verbatim contexts may follow actions that render no text
+	dir = t.TempDir()
+	g := &Generator{BaseDir: dir, Data: map[string]interface{}{"A": []interface{}{"a", "b"}}}
+	if err := g.Run("{{range .A}}>>>{{.}}.txt verbatim\n{{x}}\n<<<{{.}}.txt\n{{end}}"); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(got) != "{{x}}\n" {
+			t.Errorf("%s contains %#v; want %#v", name, string(got), "{{x}}\n")
+		}
+	}
+
+	// the content of verbatim contexts that are only recognized after the rendering is not rendered
+	err = (&Generator{BaseDir: t.TempDir()}).Run("{{$x := 1}}\n{{- if true}}>>>a.txt verbatim\n{{$x}}\n<<<a.txt\n{{end}}")
+	if got, want := fmt.Sprint(err), `syntax error at x:2: content of verbatim file "a.txt" can't be extracted: the line must start with >>>`; got != want {
+		t.Errorf("Run returned %#v; want %#v", got, want)
+	}
+}
+
+func TestTemplateDir(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "tmpl")
+	os.MkdirAll(filepath.Join(src, "#model", "sub"), 0755)
+	os.MkdirAll(filepath.Join(src, "{{.Name}}"), 0755)
+
+	files := map[string]string{
+		HeadFile:              "{\"Name\": \"project\", \"$defaults\": {\"Model\": \"User\"}}\n",
+		"#model/{{.Name}}.go": "package {{toLower .Model}}\n",
+		"#model/sub/a.txt":    "{{.Model}}",
+		"{{.Name}}/run.bat":   "echo {{.Name}}\r\n",
+		"{{.Name}}/logo.png":  "\x89PNG\r\n\x1a\n\x00{{.Name}}",
+		"README.md":           "# {{.Name}}",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(content), 0644)
+	}
+
+	head, _, _, err := ReadTemplateDir(src)
+	if err != nil {
+		t.Fatalf("ReadTemplateDir returned error: %v", err)
+	}
+	if want := strings.TrimSpace(files[HeadFile]); head != want {
+		t.Errorf("ReadTemplateDir returned head %#v; want %#v", head, want)
+	}
+	defaults, _ := HeadDefaults(head)
+
+	dir := t.TempDir()
+	g := &Generator{BaseDir: dir, Data: map[string]interface{}{"Name": "shop"}, Defaults: defaults}
+	if err := g.RunDir(src); err != nil {
+		t.Fatalf("RunDir returned error: %v", err)
+	}
+
+	expected := map[string]string{
+		"user/shop.go":   "package user\n",
+		"user/sub/a.txt": "User",
+		"shop/run.bat":   "echo shop\r\n",
+		"shop/logo.png":  files["{{.Name}}/logo.png"],
+		"README.md":      "# shop",
+	}
+	for name, want := range expected {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || string(got) != want {
+			t.Errorf("%s contains %#v (%v); want %#v", name, string(got), err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, HeadFile)); !os.IsNotExist(err) {
+		t.Errorf("the head file was generated")
+	}
+
+	ioutil.WriteFile(filepath.Join(src, "bad.txt"), []byte("a\n<<<bad.txt\n"), 0644)
+	want := `can't use "` + filepath.Join(src, "bad.txt") + `" as template: lines must not start with >>> or <<<`
+	if err := g.RunDir(src); fmt.Sprint(err) != want {
+		t.Errorf("RunDir returned %v; want %s", err, want)
+	}
+}
+
+func TestTemplateDirErrors(t *testing.T) {
+	tests := []struct {
+		files    map[string]string
+		expected string
+	}{
+		{map[string]string{"a/one.txt": "1\n", "a/two.txt": "one\n{{len 3}}\n"}, "template: %s/a/two.txt:2:2: executing"},
+		{map[string]string{"a/one.txt": "1\n", "a/two.txt": "one\n{{nofunc}}\n"}, "template: %s/a/two.txt:2: function \"nofunc\" not defined"},
+		{map[string]string{"a/one.txt": "1\n", "a/two.txt": "one\n{{\"<<<\"}}x\n"}, "syntax error at %s/a/two.txt:2: "},
+		{map[string]string{"a/one.txt": "1\n", "b/{{len 3}}.txt": "x\n"}, "template: %s/b/{{len 3}}.txt: executing"},
+		{map[string]string{"a/{{if .X}}x{{end}}": "x\n"}, "syntax error at %s/a/{{if .X}}x{{end}}: rendered line "},
+	}
+
+	for _, test := range tests {
+		src := t.TempDir()
+		for name, content := range test.files {
+			file := filepath.Join(src, filepath.FromSlash(name))
+			os.MkdirAll(filepath.Dir(file), 0755)
+			ioutil.WriteFile(file, []byte(content), 0644)
+		}
+
+		want := fmt.Sprintf(filepath.FromSlash(test.expected), src)
+		err := (&Generator{BaseDir: t.TempDir(), Name: src}).RunDir(src)
+		if got := fmt.Sprint(err); !strings.HasPrefix(got, want) {
+			t.Errorf("RunDir(%v) returned %#v; want prefix %#v", test.files, got, want)
+		}
+	}
+
+	// Lint refers to the files too
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a", "one.txt"), []byte("1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "a", "two.txt"), []byte("one\n{{.Nam}}\n"), 0644)
+	head, body, sources, _ := ReadTemplateDir(src)
+	_, err := (&Generator{Name: src, Sources: sources}).Lint(`{"Name": ""}`+head, body)
+	if got, want := fmt.Sprint(err), filepath.Join(src, "a", "two.txt")+":2: unknown field Nam"; got != want {
+		t.Errorf("Lint returned %#v; want %#v", got, want)
+	}
+}
+
+func TestTextBeforeContext(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{">>>a/\nfoo\n>>>b.txt\nX\n<<<b.txt\n<<<a/\n", "X\n"},
+		{"foo\n\n>>>a/\n\n>>>b.txt\nX\n<<<b.txt\n\n<<<a/\n", "X\n"},
+		{">>>a/\n>>>c.txt\nC\n<<<c.txt\nfoo\n>>>b.txt\nX\n<<<b.txt\n<<<a/\n", "X\n"},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		if err := (&Generator{BaseDir: dir}).Run(test.body); err != nil {
+			t.Fatalf("Run(%#v) returned error: %v", test.body, err)
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, "a", "b.txt")); string(got) != test.expected {
+			t.Errorf("Run(%#v) wrote %#v; want %#v", test.body, string(got), test.expected)
+		}
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{}\n\n>>>a.txt\nx\ny\n<<<a.txt\n", "x\ny\n"},
+		{"{}\r\n\r\n>>>a.txt\r\nx\r\ny\r\n<<<a.txt\r\n", "x\r\ny\r\n"},
+		{"{}\r\n\r\n>>>a.txt eol=lf\r\nx\r\ny\r\n<<<a.txt\r\n", "x\ny\n"},
+		{"{}\n\n>>>a.txt eol=crlf\nx\ny\r\n<<<a.txt\n", "x\r\ny\r\n"},
+		{"{}\n\n>>>a.txt noeol\nx\ny\n<<<a.txt\n", "x\ny"},
+		{"{}\n\n>>>a.txt eol=crlf noeol\nx\ny\n<<<a.txt\n", "x\r\ny"},
+		{"{}\n\n>>>a.txt noeol\n<<<a.txt\n", ""},
+		{"{}\n\n>>>a.txt noeol verbatim eol=crlf\n{{x}}\r\n<<<a.txt\n", "{{x}}"},
+		{"{}\n\n>>>a.txt noeol\na\r\n<<<a.txt\n", "a\r"},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		head, body := SplitTemplate(test.template)
+		if head != "{}" {
+			t.Errorf("SplitTemplate(%#v) returned head %#v; want %#v", test.template, head, "{}")
+		}
+		if err := (&Generator{BaseDir: dir}).Run(body); err != nil {
+			t.Fatalf("Run(%#v) returned error: %v", body, err)
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt")); string(got) != test.expected {
+			t.Errorf("Run(%#v) wrote %#v; want %#v", body, string(got), test.expected)
+		}
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	line := strings.Repeat("{{.Name}} ", 512*1024)
+	expected := strings.Repeat("long ", 512*1024) + "\n"
+
+	dir := t.TempDir()
+	body := ">>>a.txt\n" + line + "\n<<<a.txt\n"
+	g := &Generator{BaseDir: dir, Data: map[string]interface{}{"Name": "long"}}
+	if err := g.Run(body); err != nil {
+		t.Fatalf("Run(<%d bytes>) returned error: %v", len(body), err)
+	}
+	got, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	if string(got) != expected {
+		t.Errorf("Run(<%d bytes>) wrote %d bytes; want %d", len(body), len(got), len(expected))
+	}
+}
+
+func TestUnsafePath(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	dir := filepath.Join(root, "target")
+	outside := filepath.Join(root, "outside")
+	os.MkdirAll(dir, 0755)
+	os.MkdirAll(outside, 0755)
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skipf("can't create symlink: %v", err)
+	}
+
+	body := ">>>{{.Name}}/\n>>>a.txt\nA\n<<<a.txt\n<<<{{.Name}}/\n"
+
+	tests := []struct {
+		name     string
+		unsafe   bool
+		expected string
+	}{
+		{"sub", false, ""},
+		{"sub/../other", false, ""},
+		{"../outside", false, `unsafe path at x:2: "` + filepath.Join(outside, "a.txt") + `" is outside of the base directory`},
+		{"link", false, `unsafe path at x:2: "` + filepath.Join(dir, "link", "a.txt") + `" is outside of the base directory (resolves to "` + filepath.Join(outside, "a.txt") + `")`},
+		{"link/new", false, `unsafe path at x:2: "` + filepath.Join(dir, "link", "new", "a.txt") + `" is outside of the base directory (resolves to "` + filepath.Join(outside, "new", "a.txt") + `")`},
+		{"../outside", true, ""},
+	}
+
+	for _, test := range tests {
+		g := &Generator{BaseDir: dir, Data: map[string]interface{}{"Name": test.name}, Unsafe: test.unsafe}
+		var got string
+		if err := g.Run(body); err != nil {
+			got = err.Error()
+		}
+		if got != test.expected {
+			t.Errorf("Run with Name %#v = %#v; want %#v", test.name, got, test.expected)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(outside, "new")); err == nil {
+		t.Errorf("directory created outside of the base directory")
+	}
+}
+
+func TestUnsafeAsset(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	assets := filepath.Join(root, "assets")
+	os.MkdirAll(filepath.Join(assets, "img"), 0755)
+	ioutil.WriteFile(filepath.Join(assets, "img", "logo.png"), []byte("logo"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644)
+	if err := os.Symlink(root, filepath.Join(assets, "link")); err != nil {
+		t.Skipf("can't create symlink: %v", err)
+	}
+
+	body := ">>>x.txt asset={{.Path}}\n<<<x.txt\n"
+
+	tests := []struct {
+		path     string
+		unsafe   bool
+		expected string
+	}{
+		{"img/logo.png", false, ""},
+		{"../secret", false, `unsafe path at x:1: "` + filepath.Join(root, "secret") + `" is outside of the asset directory`},
+		{"link/secret", false, `unsafe path at x:1: "` + filepath.Join(assets, "link", "secret") + `" is outside of the asset directory (resolves to "` + filepath.Join(root, "secret") + `")`},
+		{"../secret", true, ""},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		g := &Generator{BaseDir: dir, AssetDir: assets, Data: map[string]interface{}{"Path": test.path}, Unsafe: test.unsafe}
+		var got string
+		if err := g.Run(body); err != nil {
+			got = err.Error()
+		}
+		if got != test.expected {
+			t.Errorf("Run with Path %#v = %#v; want %#v", test.path, got, test.expected)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "x.txt")); (err == nil) != (test.expected == "") {
+			t.Errorf("Run with Path %#v: x.txt exists: %v", test.path, err == nil)
+		}
+	}
+}
+
+func TestUnsafeBackupAndState(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	outside := filepath.Join(root, "outside")
+	dir := filepath.Join(root, "dir")
+	os.MkdirAll(outside, 0755)
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0644)
+	if err := os.Symlink(filepath.Join(outside, "a.txt.bak"), filepath.Join(dir, "a.txt.bak")); err != nil {
+		t.Skipf("can't create symlink: %v", err)
+	}
+
+	// a dangling symlink is not a free backup name
+	err := Run(dir, ">>>a.txt\nnew\n<<<a.txt\n", strings.NewReader(`{}`), nil, false, OnConflict(ConflictBackup))
+	if err != nil {
+		t.Fatalf("Run(..., OnConflict(backup)) returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "a.txt.bak")); !os.IsNotExist(err) {
+		t.Errorf("Run(..., OnConflict(backup)) wrote the backup through a symlink")
+	}
+	if backup, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt.bak.1")); string(backup) != "old" {
+		t.Errorf("Run(..., OnConflict(backup)) backup is %#v; want %#v", string(backup), "old")
+	}
+
+	// the state dir must not lead outside of the base dir
+	os.Symlink(outside, filepath.Join(dir, StateDir))
+	err = Run(dir, ">>>b.txt\nnew\n<<<b.txt\n", strings.NewReader(`{}`), nil, false, OnConflict(ConflictMerge))
+	if _, is := err.(*UnsafePathError); !is {
+		t.Errorf("Run(..., OnConflict(merge)) with symlinked state dir returned %v; want UnsafePathError", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("Run(..., OnConflict(merge)) wrote the state through a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("Run(..., OnConflict(merge)) was not rolled back")
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.txt")
+	ioutil.WriteFile(existing, []byte("old\n"), 0644)
+
+	body := ">>>existing.txt\nnew\n<<<existing.txt\n>>>a/\n>>>b/\n>>>c.txt\nC\n<<<c.txt\n<<<b/\n<<<a/\n>>>d.txt\nD\n<<<d.txt\n"
+
+	files := func() string {
+		var found []string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			rel, _ := filepath.Rel(dir, path)
+			found = append(found, filepath.ToSlash(rel))
+			return nil
+		})
+		return strings.Join(found, ",")
+	}
+
+	// a syntax error at the end: nothing is written
+	err := Run(dir, body+">>>e.txt\n", strings.NewReader("{}"), nil, false)
+	if err == nil {
+		t.Fatalf("expected syntax error")
+	}
+	if got, want := files(), ".,existing.txt"; got != want {
+		t.Errorf("after syntax error files are %#v; want %#v", got, want)
+	}
+
+	// an error while writing the last file: everything is rolled back
+	for _, policy := range []ConflictPolicy{ConflictOverwrite, ConflictBackup, ConflictMerge} {
+		g := &Generator{
+			BaseDir:    dir,
+			OnConflict: policy,
+			Hooks: Hooks{AfterWrite: func(file string) error {
+				if filepath.Base(file) == "d.txt" {
+					return ErrFileExists(file)
+				}
+				return nil
+			}},
+		}
+		err = g.Run(body)
+		if _, is := err.(ErrFileExists); !is {
+			t.Fatalf("[%s] expected ErrFileExists, got %v", policy, err)
+		}
+		if got, want := files(), ".,existing.txt"; got != want {
+			t.Errorf("[%s] after rollback files are %#v; want %#v", policy, got, want)
+		}
+		if content, _ := ioutil.ReadFile(existing); string(content) != "old\n" {
+			t.Errorf("[%s] after rollback existing file contains %#v", policy, string(content))
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a", "same.txt"), []byte("same\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a", "changed.txt"), []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n"), 0644)
+
+	body := ">>>a/\n>>>same.txt\nsame\n<<<same.txt\n>>>changed.txt\n1\n2\n3\n4\n5\nsix\n7\n8\n9\n<<<changed.txt\n>>>b/\n>>>new.txt\n<<<new.txt\n<<<b/\n<<<a/\n"
+
+	plan, err := (&Generator{BaseDir: dir}).Plan(body)
+	if err != nil {
+		t.Fatalf("Plan returned error: %v", err)
+	}
+
+	expected := `unchanged  a/
+unchanged  a/same.txt
+modify     a/changed.txt
+--- a/a/changed.txt
++++ b/a/changed.txt
+@@ -3,7 +3,7 @@
+ 3
+ 4
+ 5
+-6
++six
+ 7
+ 8
+ 9
+create     a/b/
+create     a/b/new.txt
+`
+
+	if got, want := plan.String(), expected; got != want {
+		t.Errorf("Plan(...) = \n%s\nwant\n%s", got, want)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a", "b")); !os.IsNotExist(err) {
+		t.Errorf("Plan(...) created directory a/b")
+	}
+}
+
+var schemaHead = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"required": ["Models"],
+	"properties": {
+		"Models": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"required": ["Name"],
+				"properties": {
+					"Name": {"type": "string"},
+					"Kind": {"enum": ["table", "view"]},
+					"Fields": {
+						"type": "array",
+						"items": {
+							"type": "object",
+							"required": ["Name", "Type"],
+							"properties": {
+								"Name": {"type": "string"},
+								"Type": {"type": "string"}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}`
+
+func TestParseSchema(t *testing.T) {
+	s, err := ParseSchema(validHead)
+	if s != nil || err != nil {
+		t.Errorf("ParseSchema(validHead) = %v, %v; want nil, nil", s, err)
+	}
+
+	s, err = ParseSchema("some text")
+	if s != nil || err != nil {
+		t.Errorf("ParseSchema(\"some text\") = %v, %v; want nil, nil", s, err)
+	}
+
+	s, err = ParseSchema(schemaHead)
+	if s == nil || err != nil {
+		t.Fatalf("ParseSchema(schemaHead) = %v, %v; want schema", s, err)
+	}
+
+	if got, want := s.Properties["Models"].Items.Required[0], "Name"; got != want {
+		t.Errorf("ParseSchema(schemaHead).Properties[\"Models\"].Items.Required[0] = %#v; want %#v", got, want)
+	}
+
+	// lists of types and unsupported keywords
+	s, err = ParseSchema(`{"$schema": "", "properties": {"Comment": {"type": ["string", "null"], "maxLength": 3}}}`)
+	if s == nil || err != nil {
+		t.Fatalf("ParseSchema with list of types = %v, %v; want schema", s, err)
+	}
+	for data, want := range map[string]string{
+		`{"Comment": "a"}`:  "",
+		`{"Comment": null}`: "",
+		`{"Comment": 1}`:    "invalid placeholders:\n  $.Comment: expected string or null, got integer",
+	} {
+		d, _ := convertJSON(strings.NewReader(data))
+		var got string
+		if err := s.Validate(d); err != nil {
+			got = err.Error()
+		}
+		if got != want {
+			t.Errorf("Validate(%s) = %#v; want %#v", data, got, want)
+		}
+	}
+	if got, want := s.example().(*exampleObject).values["Comment"], ""; got != want {
+		t.Errorf("example of list of types = %#v; want %#v", got, want)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	s, _ := ParseSchema(schemaHead)
+
+	tests := []struct {
+		json, expected string
+	}{
+		{validJSON, ""},
+		{`{}`, "$.Models: missing required property"},
+		{`{"Models": {}}`, "$.Models: expected array, got object"},
+		{`{"Models": [{"Name": 3}]}`, "$.Models[0].Name: expected string, got integer"},
+		{`{"Models": [{"Name": "a", "Kind": "x"}]}`, "$.Models[0].Kind: x is not one of [table view]"},
+		{`{"Models": [{"Fields": [{"Name": "a"}]}]}`, "$.Models[0].Name: missing required property\n$.Models[0].Fields[0].Type: missing required property"},
+	}
+
+	for _, test := range tests {
+		data, _ := convertJSON(strings.NewReader(test.json))
+		err := s.Validate(data)
+
+		var got string
+		if err != nil {
+			for i, e := range err.(ValidationError) {
+				if i > 0 {
+					got += "\n"
+				}
+				got += e.Error()
+			}
+		}
+
+		if got != test.expected {
+			t.Errorf("Validate(%s) = %#v; want %#v", test.json, got, test.expected)
+		}
+	}
+
+	g := &Generator{Schema: s, DryRun: true}
+	if err := g.Run(validBody); err == nil {
+		t.Errorf("Generator.Run with schema and without data returned no error")
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	answers := strings.Join([]string{
+		"y", "person", // Models[0]
+		"y", "first_name", "string", // Models[0].Fields[0]
+		"n",
+		"y", "address", // Models[1]
+		"n",
+		"n",
+	}, "\n") + "\n"
+
+	var out bytes.Buffer
+	data, err := Prompt(validHead, strings.NewReader(answers), &out)
+	if err != nil {
+		t.Fatalf("Prompt returned error: %v", err)
+	}
+
+	got, _ := json.Marshal(data)
+	want := `{"Models":[{"Fields":[{"Name":"first_name","Type":"string"}],"Name":"person"},{"Fields":[],"Name":"address"}]}`
+	if string(got) != want {
+		t.Errorf("Prompt(validHead, ...) = %s; want %s", got, want)
+	}
+
+	if got, want := strings.Count(out.String(), "Models[0].Fields[0].Name: "), 1; got != want {
+		t.Errorf("Prompt asked %d times for Models[0].Fields[0].Name; want %d", got, want)
+	}
+
+	if _, err := Prompt(validHead, strings.NewReader("y\n"), &out); err == nil {
+		t.Errorf("Prompt with incomplete answers returned no error")
+	}
+
+	if _, err := Prompt("some text", strings.NewReader(answers), &out); err == nil {
+		t.Errorf("Prompt with text head returned no error")
+	}
+}
+
+func TestDecode(t *testing.T) {
+
+	tests := []struct {
+		format, input string
+	}{
+		{"json", `{"Name": "person", "Count": 2, "Tags": ["a", "b"], "Sub": {"On": true}}`},
+		{"yaml", "Name: person\nCount: 2\nTags:\n  - a\n  - b\nSub:\n  On: true\n"},
+		{"toml", "Name = \"person\"\nCount = 2\nTags = [\"a\", \"b\"]\n[Sub]\nOn = true\n"},
+	}
+
+	want := `{"Count":2,"Name":"person","Sub":{"On":true},"Tags":["a","b"]}`
+
+	for _, test := range tests {
+		data, err := Decode(test.format, strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("Decode(%#v, ...) returned error: %v", test.format, err)
+			continue
+		}
+		if got, _ := json.Marshal(data); string(got) != want {
+			t.Errorf("Decode(%#v, ...) = %s; want %s", test.format, got, want)
+		}
+		if _, is := data["Count"].(float64); !is {
+			t.Errorf("Decode(%#v, ...) returned Count of type %T; want float64", test.format, data["Count"])
+		}
+	}
+
+	env := "# comment\nexport NAME=person\nQUOTED=\"a\\tb\"\nSINGLE='a\\tb'\n"
+	data, err := Decode("env", strings.NewReader(env))
+	if err != nil {
+		t.Fatalf("Decode(\"env\", ...) returned error: %v", err)
+	}
+	if got, _ := json.Marshal(data); string(got) != `{"NAME":"person","QUOTED":"a\tb","SINGLE":"a\\tb"}` {
+		t.Errorf("Decode(\"env\", ...) = %s", got)
+	}
+
+	for file, format := range map[string]string{"a.yml": "yaml", "b.JSON": "json", "c.toml": "toml", ".env": "env", "d.txt": ""} {
+		if got := FormatOf(file); got != format {
+			t.Errorf("FormatOf(%#v) = %#v; want %#v", file, got, format)
+		}
+	}
+}
+
+func TestMergeAndSet(t *testing.T) {
+	defaults, _ := convertJSON(strings.NewReader(`{"Package": "models", "DB": {"Driver": "pg", "Port": 5432}, "Models": [{"Name": "a"}]}`))
+	project, _ := convertJSON(strings.NewReader(`{"DB": {"Port": 5433}, "Models": [{"Name": "b"}]}`))
+
+	data := Merge(defaults, project)
+
+	sets := []struct {
+		path, value string
+	}{
+		{"Models.0.Name", "person"},
+		{"Models.1.Name", "address"},
+		{"DB.SSL", "true"},
+		{"Tags.0", "x"},
+		{"Version", "1.10"},
+		{"Build", "007"},
+		{"Replicas", "3"},
+		{"Quoted", `"3"`},
+		{"Empty", "null"},
+	}
+
+	for _, s := range sets {
+		if err := Set(data, s.path, ParseValue(s.value)); err != nil {
+			t.Errorf("Set(data, %#v, ...) returned error: %v", s.path, err)
+		}
+	}
+
+	got, _ := json.Marshal(data)
+	want := `{"Build":"007","DB":{"Driver":"pg","Port":5433,"SSL":true},"Empty":null,"Models":[{"Name":"person"},{"Name":"address"}],"Package":"models","Quoted":"3","Replicas":3,"Tags":["x"],"Version":"1.10"}`
+	if string(got) != want {
+		t.Errorf("Merge and Set = %s; want %s", got, want)
+	}
+
+	if got, _ := json.Marshal(defaults); string(got) != `{"DB":{"Driver":"pg","Port":5432},"Models":[{"Name":"a"}],"Package":"models"}` {
+		t.Errorf("Merge changed the first layer: %s", got)
+	}
+
+	overrides := map[string]string{
+		"a=1,b=2":        `["a=1","b=2"]`,
+		`a=1\,5,b=x\\,c`: `["a=1,5","b=x\\","c"]`,
+		`a=\x`:           `["a=\\x"]`,
+		"":               `[""]`,
+	}
+	for s, want := range overrides {
+		if got, _ := json.Marshal(SplitOverrides(s)); string(got) != want {
+			t.Errorf("SplitOverrides(%#v) = %s; want %s", s, got, want)
+		}
+	}
+
+	for _, path := range []string{"Models.5.Name", "Package.Name", "Models.x"} {
+		if err := Set(data, path, "v"); err == nil {
+			t.Errorf("Set(data, %#v, ...) returned no error", path)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	head := `{
+	"Models": [{"Name": "", "Table": ""}],
+	"$defaults": {"Package": "models", "DB": {"Driver": "pg"}}
+}`
+
+	defaults, err := HeadDefaults(head)
+	if err != nil {
+		t.Fatalf("HeadDefaults returned error: %v", err)
+	}
+
+	schema, _ := ParseSchema(`{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"properties": {
+		"Models": {"type": "array", "items": {"properties": {"Table": {"type": "string", "default": "items"}}}}
+	}
+}`)
+
+	g := &Generator{
+		Defaults: defaults,
+		Schema:   schema,
+		Data:     map[string]interface{}{"DB": map[string]interface{}{"Port": 5432.0}, "Models": []interface{}{map[string]interface{}{"Name": "a"}}},
+		DryRun:   true,
+	}
+
+	plan, err := g.Plan(">>>{{.Package}}/\n{{range .Models}}>>>{{.Name}}-{{.Table}}-{{$.DB.Driver}}-{{$.DB.Port}}.go\n<<<{{.Name}}-{{.Table}}-{{$.DB.Driver}}-{{$.DB.Port}}.go\n{{end}}<<<{{.Package}}/\n")
+	if err != nil {
+		t.Fatalf("Plan returned error: %v", err)
+	}
+
+	if got, want := plan[len(plan)-1].Path, "models/a-items-pg-5432.go"; got != want {
+		t.Errorf("generated %#v; want %#v", got, want)
+	}
+
+	if _, has := g.Data["Package"]; has {
+		t.Errorf("defaults were merged into Data")
+	}
+
+	if _, has := g.Data["Models"].([]interface{})[0].(map[string]interface{})["Table"]; has {
+		t.Errorf("schema defaults were set inside Data")
+	}
+
+	if d, _ := HeadDefaults(validHead); d != nil {
+		t.Errorf("HeadDefaults(validHead) = %v; want nil", d)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	template := "{\"Name\": \"\"}\n\n>>>{{.Name}}.txt\n{{.Nmae}}\n<<<{{.Name}}.txt\n"
+	_, body := SplitTemplate(template)
+
+	if got, want := BodyOffset(template), 2; got != want {
+		t.Errorf("BodyOffset(...) = %d; want %d", got, want)
+	}
+
+	if got, want := BodyOffset(">>>a.txt\n<<<a.txt\n"), 0; got != want {
+		t.Errorf("BodyOffset(without head) = %d; want %d", got, want)
+	}
+
+	g := &Generator{Data: map[string]interface{}{"Name": "a"}, DryRun: true}
+	if err := g.Run(body); err != nil {
+		t.Errorf("Run without strict mode returned error: %v", err)
+	}
+
+	g.Strict = true
+	g.Name = "my.templ"
+	g.LineOffset = BodyOffset(template)
+	err := g.Run(body)
+	if err == nil {
+		t.Fatalf("Run in strict mode returned no error")
+	}
+
+	if got, want := err.Error(), "template: my.templ:4:2: "; !strings.HasPrefix(got, want) {
+		t.Errorf("Run in strict mode returned error %#v; want prefix %#v", got, want)
+	}
+
+	err = Run("start", body, strings.NewReader(`{"Name": "a"}`), nil, true, Strict())
+	if err == nil {
+		t.Errorf("Run(..., Strict()) returned no error")
+	}
+}
+
+func TestSyntaxErrorPosition(t *testing.T) {
+	template := `{"Models": [{"Name": ""}]}
+
+>>>models/
+{{range .Models}}
+>>>{{.Name}}/
+>>>model.go
+{{range .Fields}}
+{{if eq .Name "bad"}}<<<wrong.go{{end}}
+{{end}}
+<<<model.go
+<<<{{.Name}}/
+{{end}}
+<<<models/
+`
+	_, body := SplitTemplate(template)
+	json := `{"Models": [{"Name": "a", "Fields": [{"Name": "x"}]}, {"Name": "b", "Fields": [{"Name": "y"}, {"Name": "bad"}]}]}`
+
+	err := Run("start", body, strings.NewReader(json), nil, true, func(g *Generator) {
+		g.Name = "models.templ"
+		g.LineOffset = BodyOffset(template)
+	})
+
+	want := `syntax error at models.templ:8 (iteration 1 of range .Models at line 4, iteration 1 of range .Fields at line 7): closing file "wrong.go" but should close file "model.go"`
+	if err == nil || err.Error() != want {
+		t.Errorf("Run(...) returned error %v; want %s", err, want)
+	}
+
+	if _, is := err.(*SyntaxError); !is {
+		t.Errorf("Run(...) returned error of type %T; want *SyntaxError", err)
+	}
+
+	err = Run("start", "{{range .Models}}{{.Name.X}}{{end}}", strings.NewReader(json), nil, true)
+	if err == nil || !strings.HasSuffix(err.Error(), "(iteration 0 of range .Models at line 1)") {
+		t.Errorf("Run(...) returned error %v; want error in iteration 0", err)
+	}
+}
+
+func TestUnclosedContexts(t *testing.T) {
+	err := Run("start", ">>>a/\n>>>b/\n<<<b/\n>>>file.txt\nhello\n", strings.NewReader(`{}`), nil, true)
+
+	errs, is := err.(SyntaxErrors)
+	if !is {
+		t.Fatalf("Run(...) returned %v; want SyntaxErrors", err)
+	}
+
+	want := "syntax error at x:1: dir \"a/\" is not closed\nsyntax error at x:4: file \"file.txt\" is not closed"
+	if got := errs.Error(); got != want {
+		t.Errorf("Run(...) returned error %#v; want %#v", got, want)
+	}
+}
+
+func TestLint(t *testing.T) {
+
+	tests := []struct {
+		body, expected string
+	}{
+		{validBody, ""},
+		{">>>a/\n>>>b.txt\n<<<b.txt\n", `syntax error at x:1: dir "a/" is not closed`},
+		{">>>a/\n>>>b.txt\n>>>c/\n<<<c/\n<<<b.txt\n<<<a/\n", `syntax error at x:3: embedding folder within file is not allowed ("c/" inside "b.txt")`},
+		{
+			"{{range .Models}}\n>>>{{.Name}}/\n<<<{{toLower .Name}}/\n{{end}}\n<<<x.txt\n>>>\n",
+			`syntax error at x:3: closing dir "{{toLower .Name}}/" but should close dir "{{.Name}}/"` + "\n" +
+				`syntax error at x:5: closing file "x.txt" but there is no open context` + "\n" +
+				`syntax error at x:6: missing name of context`,
+		},
+		{"{{range .Models}}>>>routes.go insert=routes\n\troute(\"{{.}}\")\n<<<routes.go\n>>>all.txt append\n{{.}}\n<<<all.txt\n{{end}}\n", ""},
+		{"{{/* routes */}}{{$m := .Models}}<<<routes.go\n", `syntax error at x:1: closing file "routes.go" but there is no open context`},
+		{"{{.Prefix}}<<<routes.go\n", ""},
+	}
+
+	for _, test := range tests {
+		var got string
+		if _, err := (&Generator{}).Lint("", test.body); err != nil {
+			got = err.Error()
+		}
+		if got != test.expected {
+			t.Errorf("Lint(%#v) = %#v; want %#v", test.body, got, test.expected)
+		}
+	}
+}
+
+func TestLintTemplate(t *testing.T) {
+	head := `{"Project": "", "Models": [{"Name": "", "Path": "a/b", "Fields": [{"Name": ""}]}]}`
+
+	tests := []struct {
+		head, body string
+		fields     string
+		expected   string
+	}{
+		{
+			head,
+			">>>{{.Project}}/\n{{range $m := .Models}}\n>>>{{toLower $m.Name}}.go\n{{range .Fields}}{{.Name}} {{$.Project}}\n{{end}}\n<<<{{toLower $m.Name}}.go\n{{end}}\n<<<{{.Project}}/\n",
+			"Models,Models[].Fields,Models[].Fields[].Name,Models[].Name,Project",
+			"",
+		},
+		{
+			head,
+			"{{with .Models}}{{range .}}{{.Nam}}{{end}}{{end}}\n{{camel .Project}}\n",
+			"Models,Models[].Nam,Project",
+			"x:1: unknown field Models[].Nam\nx:2: unknown function \"camel\"",
+		},
+		{
+			"",
+			"{{.Anything}}\n",
+			"Anything",
+			"",
+		},
+		{
+			head,
+			"{{range .Models}}\n>>>{{.Path}}.go\n<<<{{.Path}}.go\n{{end}}\n>>>{{.Project}}{{.Missing}}.txt\n<<<{{.Project}}{{.Missing}}.txt\n>>>{{if false}}x{{end}}/\n<<<{{if false}}x{{end}}/\n",
+			"Missing,Models,Models[].Path,Project",
+			`x:2: name of context "{{.Path}}.go" contains a path separator after rendering ("a/b.go")` + "\n" +
+				`x:5: unknown field Missing` + "\n" +
+				`x:7: name of context "{{if false}}x{{end}}/" is empty after rendering`,
+		},
+		{
+			head,
+			"{{end}}\n",
+			"",
+			"template: x:1: unexpected {{end}}",
+		},
+		{
+			`{"Name": "", "$defaults": {"Package": "models", "Options": {"Tags": true}}}`,
+			"package {{.Package}}\n{{.Name}}{{.Options.Tags}}{{.Options.Other}}{{.Other}}\n",
+			"Name,Options.Other,Options.Tags,Other,Package",
+			"x:2: unknown field Options.Other\nx:2: unknown field Other",
+		},
+	}
+
+	for _, test := range tests {
+		var got string
+		fields, err := (&Generator{}).Lint(test.head, test.body)
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.expected {
+			t.Errorf("Lint(%#v) = %#v; want %#v", test.body, got, test.expected)
+		}
+		if f := strings.Join(fields, ","); f != test.fields {
+			t.Errorf("Lint(%#v) fields = %#v; want %#v", test.body, f, test.fields)
+		}
+	}
+}
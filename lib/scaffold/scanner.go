@@ -2,6 +2,7 @@ package scaffold
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 var fileVar = regexp.MustCompile("^#([a-zA-Z_]+)$")
@@ -19,7 +21,36 @@ type scanner struct {
 	bf             bytes.Buffer
 	skipDirRegex   *regexp.Regexp
 	openDirs       []string
+	openDirPaths   []string
 	currentDirPath string
+	root           string
+	assetDir       string
+
+	// template is true if the scanned directory is a template directory (see ReadTemplateDir)
+	template bool
+
+	// sources are the origins of the lines of a template directory, lines is the number of lines
+	// of bf up to the offset counted
+	sources Sources
+	lines   int
+	counted int
+}
+
+// newline starts a new context on the next line, which belongs to the name of the file or directory
+func (s *scanner) newline(path string) {
+	s.bf.WriteString("\n")
+	s.source(path, 0)
+}
+
+// source records that the lines of the body from the next one on belong to the given line of the file
+// (0 for its name), if a template directory is read
+func (s *scanner) source(path string, line int) {
+	if !s.template {
+		return
+	}
+	s.lines += bytes.Count(s.bf.Bytes()[s.counted:], []byte("\n"))
+	s.counted = s.bf.Len()
+	s.sources = append(s.sources, Source{Line: s.lines + 1, File: path, FileLine: line})
 }
 
 func (s *scanner) walkDir(path string, info os.FileInfo, err error) error {
@@ -36,11 +67,18 @@ func (s *scanner) walkDir(path string, info os.FileInfo, err error) error {
 
 	s.currentDirPath, _ = filepath.Abs(path)
 
+	// the root of a template directory is the target directory
+	if s.template && path == s.root {
+		return nil
+	}
+
 	nstr = fixName(nstr)
 
 	s.openDirs = append(s.openDirs, nstr)
+	s.openDirPaths = append(s.openDirPaths, s.currentDirPath)
 
-	s.bf.WriteString(fmt.Sprintf("\n>>>%s/\n", nstr))
+	s.newline(path)
+	s.bf.WriteString(fmt.Sprintf(">>>%s/\n", nstr))
 
 	return nil
 }
@@ -48,11 +86,20 @@ func (s *scanner) walkDir(path string, info os.FileInfo, err error) error {
 func (s *scanner) _closeDir() {
 	cdir := s.openDirs[len(s.openDirs)-1]
 
-	s.bf.WriteString(fmt.Sprintf("\n<<<%s/\n", cdir))
+	path := s.openDirPaths[len(s.openDirPaths)-1]
+	if root, err := filepath.Abs(s.root); err == nil {
+		if rel, err := filepath.Rel(root, path); err == nil {
+			path = filepath.Join(s.root, rel)
+		}
+	}
+	s.newline(path)
+	s.bf.WriteString(fmt.Sprintf("<<<%s/\n", cdir))
 	if len(s.openDirs) > 1 {
 		s.openDirs = s.openDirs[:len(s.openDirs)-1]
+		s.openDirPaths = s.openDirPaths[:len(s.openDirPaths)-1]
 	} else {
 		s.openDirs = []string{}
+		s.openDirPaths = []string{}
 	}
 }
 
@@ -62,8 +109,8 @@ func (s *scanner) closeDir(currentFile string) {
 	dir := filepath.Dir(currentFile)
 
 	// file is not part of the currentDir, that means
-	// we left the currentDir, so close the dir and set the currentDirPath accordingly
-	if !strings.Contains(s.currentDirPath, dir) && s.currentDirPath != "" {
+	// we left the currentDir, so close the dirs until the dir of the file is the current one
+	for len(s.openDirPaths) > 0 && s.openDirPaths[len(s.openDirPaths)-1] != dir {
 		s._closeDir()
 	}
 
@@ -101,20 +148,156 @@ func (s *scanner) walkFile(path string, info os.FileInfo, err error) error {
 		return err
 	}
 
+	if s.template && path == filepath.Join(s.root, HeadFile) {
+		return nil
+	}
+
 	bare, ext := splitFilename(info.Name())
 	bare = fixName(bare)
 
-	s.bf.WriteString(fmt.Sprintf("\n>>>%s\n", bare+ext))
-
 	fc, err2 := ioutil.ReadFile(path)
 
 	if err2 != nil {
 		return err2
 	}
 
-	s.bf.Write(fc)
+	if s.template && !isBinary(fc) && hasContextLine(fc) {
+		return fmt.Errorf("can't use %#v as template: lines must not start with >>> or <<<", path)
+	}
+
+	// text that would close its own verbatim context is stored like binary content
+	binary := isBinary(fc) || (!s.template && needsVerbatim(fc) && closesVerbatim(fc, bare+ext))
+
+	s.newline(path)
+	switch {
+	case s.template && !isBinary(fc):
+		eol, text := scanLineEndings(fc)
+		s.bf.WriteString(fmt.Sprintf(">>>%s\n", strings.Join(append([]string{bare + ext}, eol...), " ")))
+		s.source(path, 1)
+		s.bf.Write(text)
+		s.source(path, 0)
+		s.bf.WriteString(fmt.Sprintf("<<<%s\n", bare+ext))
+	case binary && s.assetDir != "":
+		asset, err := s.copyAsset(path, fc)
+		if err != nil {
+			return err
+		}
+		s.bf.WriteString(fmt.Sprintf(">>>%s asset=%s\n<<<%s\n", bare+ext, asset, bare+ext))
+	case binary:
+		s.bf.WriteString(fmt.Sprintf(">>>%s binary\n", bare+ext))
+		writeBase64(&s.bf, fc)
+		s.bf.WriteString(fmt.Sprintf("<<<%s\n", bare+ext))
+	default:
+		var attrs []string
+		if needsVerbatim(fc) {
+			attrs = append(attrs, "verbatim")
+		}
+		eol, text := scanLineEndings(fc)
+		attrs = append(attrs, eol...)
+		s.bf.WriteString(fmt.Sprintf(">>>%s\n", strings.Join(append([]string{bare + ext}, attrs...), " ")))
+		s.bf.Write(text)
+		s.bf.WriteString(fmt.Sprintf("<<<%s\n", bare+ext))
+	}
+	return nil
+}
+
+// scanLineEndings returns the attributes for the line endings of the text content and the text as it is put
+// into the template: consistent \r\n line endings are replaced by \n (eol=crlf) and a missing line ending after
+// the last line is added (noeol). Mixed line endings are kept as they are, so are \r\n line endings, if a
+// \r that is not part of them would become part of a line ending by the conversion.
+func scanLineEndings(content []byte) (attrs []string, text []byte) {
+	text = content
+	if crlf := bytes.Count(text, []byte("\r\n")); crlf > 0 && crlf == bytes.Count(text, []byte("\n")) {
+		converted := bytes.Replace(text, []byte("\r\n"), []byte("\n"), -1)
+		if !bytes.Contains(converted, []byte("\r\n")) && !bytes.HasSuffix(converted, []byte("\r")) {
+			attrs = append(attrs, "eol=crlf")
+			text = converted
+		}
+	}
+	if len(text) > 0 && text[len(text)-1] != '\n' {
+		attrs = append(attrs, "noeol")
+		text = append(text[:len(text):len(text)], '\n')
+	}
+	return attrs, text
+}
+
+// isBinary checks if the content is not UTF8 text
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content, 0) != -1 || !utf8.Valid(content)
+}
+
+// needsVerbatim checks if the text content must be put into a verbatim context, because it would
+// be interpreted by text/template or contains lines that look like contexts.
+func needsVerbatim(content []byte) bool {
+	return bytes.Contains(content, []byte("{{")) || bytes.Contains(content, []byte("}}")) || hasContextLine(content)
+}
+
+// hasContextLine checks if the content has lines that look like contexts
+func hasContextLine(content []byte) bool {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte(">>>")) || bytes.HasPrefix(line, []byte("<<<")) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeBase64 writes the content base64 encoded in lines of 76 characters
+func writeBase64(bf *bytes.Buffer, content []byte) {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		bf.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+	if encoded != "" {
+		bf.WriteString(encoded + "\n")
+	}
+}
+
+// copyAsset copies the content of the file at path to the asset dir and returns
+// the slash separated path of the asset, relative to the asset dir
+func (s *scanner) copyAsset(path string, content []byte) (string, error) {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(rel, " \t") {
+		return "", fmt.Errorf("can't scan %#v as asset: path contains whitespace", path)
+	}
+	asset := filepath.Join(s.assetDir, rel)
+	if err := os.MkdirAll(filepath.Dir(asset), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(asset, content, 0644); err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// walkSymlink adds a symlink context for the symlink, without following it
+func (s *scanner) walkSymlink(path string, info os.FileInfo) error {
+	s.closeDir(path)
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(target, " \t\n") {
+		return fmt.Errorf("can't scan symlink %#v: target %#v contains whitespace", path, target)
+	}
+
+	parts := strings.Split(filepath.ToSlash(target), "/")
+	for i, part := range parts {
+		bare, ext := splitFilename(part)
+		parts[i] = fixName(bare) + ext
+	}
 
-	s.bf.WriteString(fmt.Sprintf("\n<<<%s\n", bare+ext))
+	bare, ext := splitFilename(info.Name())
+	bare = fixName(bare)
+
+	s.newline(path)
+	s.bf.WriteString(fmt.Sprintf(">>>%s link=%s\n<<<%s\n", bare+ext, strings.Join(parts, "/"), bare+ext))
 	return nil
 }
 
@@ -126,6 +309,10 @@ func (s *scanner) walk(path string, info os.FileInfo, err error) error {
 		return err
 	}
 
+	if info.Mode()&os.ModeSymlink != 0 {
+		return s.walkSymlink(path, info)
+	}
+
 	if info.IsDir() {
 		return s.walkDir(path, info, err)
 	}
@@ -136,7 +323,7 @@ func (s *scanner) walk(path string, info os.FileInfo, err error) error {
 // scans a directory recursively
 // and creates a template based on the structure of the files and directories
 func Scan(dirname string, opts ...ScanOption) (template []byte, err error) {
-	s := &scanner{}
+	s := &scanner{root: dirname}
 
 	for _, opt := range opts {
 		opt(s)
@@ -159,8 +346,45 @@ func Scan(dirname string, opts ...ScanOption) (template []byte, err error) {
 	return s.bf.Bytes(), err
 }
 
+// HeadFile is the file inside the root of a template directory that contains the head of the template.
+// It is not generated.
+const HeadFile = "scaffold.head"
+
+// ReadTemplateDir reads the template directory dir and returns the head and the body of the template.
+// Each file and directory beneath dir is turned into a context of the same name. Names might contain
+// placeholders, either as {{...}} or - as with Scan - as #Name. In contrast to Scan, the content of text files
+// is part of the template body, so it is rendered by text/template. Binary files are copied as they are.
+// The head is read from the HeadFile, if it exists. The returned sources map the lines of the body to the
+// files (see Generator.Sources), so that errors refer to the files inside dir.
+func ReadTemplateDir(dir string) (head, body string, sources Sources, err error) {
+	s := &scanner{root: dir, template: true}
+
+	err = filepath.Walk(dir, s.walk)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	for len(s.openDirs) > 0 {
+		s._closeDir()
+	}
+
+	h, err := ioutil.ReadFile(filepath.Join(dir, HeadFile))
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", nil, err
+	}
+	return strings.TrimSpace(string(h)), s.bf.String(), s.sources, nil
+}
+
 type ScanOption func(*scanner)
 
+// Assets makes Scan copy binary files to the given directory and refer to them with asset contexts
+// (see Generator.AssetDir) instead of embedding them base64 encoded into binary contexts.
+func Assets(dir string) ScanOption {
+	return func(s *scanner) {
+		s.assetDir = dir
+	}
+}
+
 func SkipDirs(regexstring string) ScanOption {
 	re := regexp.MustCompile(regexstring)
 	return func(s *scanner) {
@@ -0,0 +1,243 @@
+package scaffold
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Schema is the subset of JSON Schema (http://json-schema.org) that is supported
+// for the validation of the placeholders.
+// The supported keywords are type, properties, required, items, enum, default and description.
+// Other keywords are ignored.
+type Schema struct {
+	Type        Types              `json:"type,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Default     interface{}        `json:"default,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Enum        []interface{}      `json:"enum,omitempty"`
+}
+
+// Types are the allowed json types of a value. In json, they are either a single type
+// ("type": "string") or a list of types ("type": ["string", "null"]). No types allow every value.
+type Types []string
+
+// UnmarshalJSON accepts a single type or a list of types.
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = Types{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings: %s", data)
+	}
+	*t = Types(list)
+	return nil
+}
+
+// MarshalJSON writes a single type as string.
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// allows checks if typ is one of the types. Integers are numbers, too.
+func (t Types) allows(typ string) bool {
+	for _, tt := range t {
+		if tt == typ || (tt == "number" && typ == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// main returns the first type that is not null, or an empty string if there is none
+func (t Types) main() string {
+	for _, tt := range t {
+		if tt != "null" {
+			return tt
+		}
+	}
+	return ""
+}
+
+func (t Types) String() string {
+	return strings.Join(t, " or ")
+}
+
+// ParseSchema parses the head of a template as Schema.
+// The head is a schema, if it is a json object with a "$schema" property.
+// If it is not, nil is returned without an error.
+func ParseSchema(head string) (*Schema, error) {
+	var probe map[string]json.RawMessage
+	if json.Unmarshal([]byte(head), &probe) != nil {
+		return nil, nil
+	}
+
+	if _, has := probe["$schema"]; !has {
+		return nil, nil
+	}
+
+	var s Schema
+	if err := json.Unmarshal([]byte(head), &s); err != nil {
+		return nil, fmt.Errorf("invalid schema in head: %s", err)
+	}
+	return &s, nil
+}
+
+// HeadDefaults returns the default placeholders declared by the "$defaults" property
+// of the json object inside the head. If there is no such property, nil is returned
+// without an error.
+func HeadDefaults(head string) (map[string]interface{}, error) {
+	var probe map[string]json.RawMessage
+	if json.Unmarshal([]byte(head), &probe) != nil {
+		return nil, nil
+	}
+
+	raw, has := probe["$defaults"]
+	if !has {
+		return nil, nil
+	}
+
+	var defaults map[string]interface{}
+	if err := json.Unmarshal(raw, &defaults); err != nil {
+		return nil, fmt.Errorf("invalid $defaults in head: %s", err)
+	}
+	return defaults, nil
+}
+
+// ApplyDefaults sets the missing properties of the objects inside data to the default values
+// of the schema. Defaults of array items are applied to every entry of the array.
+func (s *Schema) ApplyDefaults(data interface{}) {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for k, prop := range s.Properties {
+			if _, has := v[k]; !has && prop.Default != nil {
+				v[k] = Normalize(prop.Default)
+			}
+			if val, has := v[k]; has {
+				prop.ApplyDefaults(val)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for _, val := range v {
+				s.Items.ApplyDefaults(val)
+			}
+		}
+	}
+}
+
+// SchemaError is a violation of the schema at the given path.
+type SchemaError struct {
+
+	// Path is the json path of the invalid value, e.g. $.Models[0].Name
+	Path    string
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationError is returned if the placeholders do not match the schema.
+type ValidationError []SchemaError
+
+func (v ValidationError) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Error()
+	}
+	return "invalid placeholders:\n  " + strings.Join(msgs, "\n  ")
+}
+
+// Validate validates the data against the schema. If the data is invalid,
+// a ValidationError is returned.
+func (s *Schema) Validate(data interface{}) error {
+	var errs ValidationError
+	s.validate("$", data, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// jsonType returns the json type of a value as decoded by encoding/json
+func jsonType(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if t == float64(int64(t)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func (s *Schema) validate(path string, data interface{}, errs *ValidationError) {
+	typ := jsonType(data)
+
+	if len(s.Type) > 0 && !s.Type.allows(typ) {
+		*errs = append(*errs, SchemaError{path, fmt.Sprintf("expected %s, got %s", s.Type, typ)})
+		return
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, data) {
+		*errs = append(*errs, SchemaError{path, fmt.Sprintf("%v is not one of %v", data, s.Enum)})
+	}
+
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for _, req := range s.Required {
+			if _, has := v[req]; !has {
+				*errs = append(*errs, SchemaError{path + "." + req, "missing required property"})
+			}
+		}
+
+		// sorted, to get a stable order of errors
+		var keys []string
+		for k := range s.Properties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if val, has := v[k]; has {
+				s.Properties[k].validate(path+"."+k, val, errs)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, val := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), val, errs)
+			}
+		}
+	}
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(v) && jsonType(e) == jsonType(v) {
+			return true
+		}
+	}
+	return false
+}
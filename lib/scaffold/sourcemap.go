@@ -0,0 +1,311 @@
+package scaffold
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Iteration is an iteration of a range action of the template body.
+type Iteration struct {
+
+	// Range is the range action, e.g. "range .Models"
+	Range string
+
+	// Line is the line of the range action inside the template file
+	Line int
+
+	// Index is the zero based index of the iteration
+	Index int
+}
+
+// Position is the origin of a line of the rendered template body.
+type Position struct {
+
+	// File is the name of the template
+	File string
+
+	// Line is the line inside the template file or 0 if it is unknown
+	Line int
+
+	// Rendered is the zero based line number inside the rendered template body
+	Rendered int
+
+	// Iterations are the iterations of the range actions that produced the line, outermost first
+	Iterations []Iteration
+}
+
+func (p Position) String() string {
+	var bf bytes.Buffer
+	if p.Line == 0 {
+		fmt.Fprintf(&bf, "%s: rendered line %d", p.File, p.Rendered)
+	} else {
+		fmt.Fprintf(&bf, "%s:%d", p.File, p.Line)
+	}
+
+	if its := p.iterations(); its != "" {
+		bf.WriteString(" (" + its + ")")
+	}
+	return bf.String()
+}
+
+func (p Position) iterations() string {
+	var its []string
+	for _, it := range p.Iterations {
+		if it.Index >= 0 {
+			its = append(its, fmt.Sprintf("iteration %d of %s at line %d", it.Index, it.Range, it.Line))
+		}
+	}
+	return strings.Join(its, ", ")
+}
+
+// SyntaxError is an error in the contexts of the rendered template body.
+type SyntaxError struct {
+	Pos Position
+	Msg string
+}
+
+func (s *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %s: %s", s.Pos, s.Msg)
+}
+
+// the markers inside the rendered body are enclosed by markerDelim and start with one of the kinds
+const (
+	markerDelim = '\x00'
+
+	markerLine       = 'L' // the following text starts at the given line of the body
+	markerRangeStart = 'S' // the range with the given id starts
+	markerIteration  = 'I' // an iteration of the range with the given id starts
+	markerRangeEnd   = 'E' // the range with the given id ends
+)
+
+func marker(kind byte, n int) string {
+	return string(markerDelim) + string(kind) + strconv.Itoa(n) + string(markerDelim)
+}
+
+// Source is the origin of the lines of a template body that was read from a template directory.
+type Source struct {
+
+	// Line is the line of the body, from which on the lines belong to File
+	Line int
+
+	// File is the path of the file or directory inside the template directory
+	File string
+
+	// FileLine is the line inside File that corresponds to Line or 0 for the lines of the context
+	// that are made from the name of File
+	FileLine int
+}
+
+// Sources map the lines of a template body to the files of a template directory (see ReadTemplateDir).
+// They are ordered by Line.
+type Sources []Source
+
+// position returns the file and the line inside it for the given line of the body
+func (s Sources) position(line int) (file string, fileLine int) {
+	i := sort.Search(len(s), func(i int) bool { return s[i].Line > line }) - 1
+	if i < 0 {
+		return "", 0
+	}
+	if s[i].FileLine == 0 {
+		return s[i].File, 0
+	}
+	return s[i].File, s[i].FileLine + line - s[i].Line
+}
+
+// sourceMap instruments the parse trees of a template, so that the rendered body contains
+// markers from which the origin of each line can be tracked.
+type sourceMap struct {
+	file    string
+	offset  int
+	sources Sources
+	ranges  []Iteration
+
+	// lineStarts are the offsets of the starts of the lines of the body
+	lineStarts []int
+}
+
+func newSourceMap(file string, offset int, body string) *sourceMap {
+	sm := &sourceMap{file: file, offset: offset, lineStarts: []int{0}}
+	for i := 0; i < len(body); i++ {
+		if body[i] == '\n' {
+			sm.lineStarts = append(sm.lineStarts, i+1)
+		}
+	}
+	return sm
+}
+
+// line returns the line of the template file for the offset inside the body
+func (sm *sourceMap) line(pos parse.Pos) int {
+	return sort.SearchInts(sm.lineStarts, int(pos)+1) + sm.offset
+}
+
+// position returns the position of the given line of the template file. If the body was read from
+// a template directory, the position refers to the file inside it.
+func (sm *sourceMap) position(line int) Position {
+	if sm.sources == nil {
+		return Position{File: sm.file, Line: line}
+	}
+	file, fileLine := sm.sources.position(line - sm.offset)
+	if file == "" {
+		return Position{File: sm.file}
+	}
+	return Position{File: file, Line: fileLine}
+}
+
+// instrument adds the markers to all templates defined by t
+func (sm *sourceMap) instrument(t *template.Template) {
+	for _, tt := range t.Templates() {
+		if tt.Tree != nil {
+			sm.instrumentList(tt.Tree.Root)
+		}
+	}
+}
+
+func (sm *sourceMap) markerNode(pos parse.Pos, kind byte, n int) *parse.TextNode {
+	return &parse.TextNode{NodeType: parse.NodeText, Pos: pos, Text: []byte(marker(kind, n))}
+}
+
+func (sm *sourceMap) instrumentList(list *parse.ListNode) {
+	if list == nil {
+		return
+	}
+
+	nodes := make([]parse.Node, 0, len(list.Nodes))
+	for _, n := range list.Nodes {
+		switch x := n.(type) {
+		case *parse.TextNode:
+			x.Text = sm.markText(x.Text, x.Pos)
+		case *parse.IfNode:
+			sm.instrumentList(x.List)
+			sm.instrumentList(x.ElseList)
+		case *parse.WithNode:
+			sm.instrumentList(x.List)
+			sm.instrumentList(x.ElseList)
+		case *parse.RangeNode:
+			id := len(sm.ranges)
+			sm.ranges = append(sm.ranges, Iteration{Range: "range " + x.Pipe.String(), Line: sm.position(sm.line(x.Pos)).Line})
+			sm.instrumentList(x.List)
+			sm.instrumentList(x.ElseList)
+			x.List.Nodes = append([]parse.Node{sm.markerNode(x.Pos, markerIteration, id)}, x.List.Nodes...)
+			nodes = append(nodes, sm.markerNode(x.Pos, markerRangeStart, id), x, sm.markerNode(x.Pos, markerRangeEnd, id))
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	list.Nodes = nodes
+}
+
+// markText adds a line marker to the start of the text and after each linefeed
+func (sm *sourceMap) markText(text []byte, pos parse.Pos) []byte {
+	line := sm.line(pos)
+	var bf bytes.Buffer
+	bf.WriteString(marker(markerLine, line))
+	for _, b := range text {
+		bf.WriteByte(b)
+		if b == '\n' {
+			line++
+			bf.WriteString(marker(markerLine, line))
+		}
+	}
+	return bf.Bytes()
+}
+
+// tracker removes the markers from the rendered lines and tracks their positions
+type tracker struct {
+	sm       *sourceMap
+	line     int
+	rendered int
+	stack    []Iteration
+}
+
+func (sm *sourceMap) tracker() *tracker {
+	return &tracker{sm: sm, rendered: -1}
+}
+
+// position returns the current position
+func (t *tracker) position() Position {
+	p := t.sm.position(t.line)
+	p.Rendered = t.rendered
+	p.Iterations = append(p.Iterations, t.stack...)
+	return p
+}
+
+// strip removes the markers from the rendered line and returns the position of the line.
+// The position is the position of the first character that is not part of a marker.
+func (t *tracker) strip(s string) (line string, pos Position) {
+	t.rendered++
+	if strings.IndexByte(s, markerDelim) == -1 {
+		return s, t.position()
+	}
+
+	var bf strings.Builder
+	var havePos bool
+	for len(s) > 0 {
+		idx := strings.IndexByte(s, markerDelim)
+		if idx != 0 {
+			if !havePos {
+				pos, havePos = t.position(), true
+			}
+			if idx == -1 {
+				bf.WriteString(s)
+				break
+			}
+			bf.WriteString(s[:idx])
+			s = s[idx:]
+		}
+
+		end := strings.IndexByte(s[1:], markerDelim)
+		n, err := -1, error(nil)
+		if end > 1 {
+			n, err = strconv.Atoi(s[2 : end+1])
+		}
+		if end < 1 || err != nil || !t.apply(s[1], n) {
+			// not a valid marker, keep the delimiter
+			if !havePos {
+				pos, havePos = t.position(), true
+			}
+			bf.WriteByte(s[0])
+			s = s[1:]
+			continue
+		}
+		s = s[end+2:]
+	}
+
+	if !havePos {
+		pos = t.position()
+	}
+	return bf.String(), pos
+}
+
+// apply applies the marker of the given kind and number and returns false for invalid markers
+func (t *tracker) apply(kind byte, n int) bool {
+	switch kind {
+	case markerLine:
+		t.line = n
+	case markerRangeStart:
+		if n >= len(t.sm.ranges) {
+			return false
+		}
+		it := t.sm.ranges[n]
+		it.Index = -1
+		t.stack = append(t.stack, it)
+	case markerIteration:
+		if len(t.stack) == 0 {
+			return false
+		}
+		t.stack[len(t.stack)-1].Index++
+	case markerRangeEnd:
+		if len(t.stack) == 0 {
+			return false
+		}
+		t.stack = t.stack[:len(t.stack)-1]
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package scaffold
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// markerVerbatim marks the line of the rendered body where the content of the verbatim context with the given id starts
+const markerVerbatim = 'V'
+
+// verbatimRegexp matches a verbatim marker and its id
+var verbatimRegexp = regexp.MustCompile(string(markerDelim) + string(markerVerbatim) + `(\d+)` + string(markerDelim))
+
+// extractVerbatim removes the content of the verbatim contexts from the body, so that it is not
+// processed by text/template. The first line of the content is replaced by a verbatim marker, the others
+// by empty lines, so that the line numbers are kept. The removed contents are returned in the order of the markers.
+// Verbatim contexts may follow actions that render no text, e.g. "{{range .Names}}>>>{{.}}.txt verbatim".
+func extractVerbatim(body string) (replaced string, verbatim [][]byte) {
+	if !strings.Contains(body, "verbatim") {
+		return body, nil
+	}
+
+	var bf strings.Builder
+	var name string // the name of the current verbatim context, empty outside of verbatim contexts
+	var start int   // the offset of the content of the current verbatim context
+	var lines int   // the number of lines of the content of the current verbatim context
+
+	for offset := 0; offset < len(body); {
+		end := strings.IndexByte(body[offset:], '\n') + 1
+		if end == 0 {
+			end = len(body) - offset
+		}
+		line := body[offset : offset+end]
+		ctx, opens, closes := contextLine(skipActions(strings.TrimRight(line, "\r\n")))
+
+		switch {
+		case name == "":
+			if opens {
+				if n, attrs, err := ParseAttributes(ctx); err == nil && attrs.Verbatim {
+					name, start, lines = n, offset+end, 0
+				}
+			}
+			bf.WriteString(line)
+		case closes && ctx == name:
+			if lines > 0 {
+				bf.WriteString(marker(markerVerbatim, len(verbatim)) + "\n")
+				bf.WriteString(strings.Repeat("\n", lines-1))
+			}
+			verbatim = append(verbatim, []byte(body[start:offset]))
+			name = ""
+			bf.WriteString(line)
+		default:
+			lines++
+		}
+		offset += end
+	}
+
+	if name != "" {
+		// unclosed context: keep the content, the syntax error is reported later
+		bf.WriteString(body[start:])
+	}
+	return bf.String(), verbatim
+}
+
+// closesVerbatim checks if a line of the content would close the verbatim context with the given name
+// (see extractVerbatim)
+func closesVerbatim(content []byte, name string) bool {
+	for _, line := range strings.Split(string(content), "\n") {
+		ctx, _, closes := contextLine(skipActions(strings.TrimRight(line, "\r")))
+		if closes && ctx == name {
+			return true
+		}
+	}
+	return false
+}
+
+// contentOf returns the content of a file context as defined by its attributes:
+// the content of verbatim contexts is taken from verbatim, binary contexts are decoded from base64
+// and assets are read from g.AssetDir.
+func (g *Generator) contentOf(c context, content []byte, verbatim [][]byte) ([]byte, error) {
+	switch {
+	case c.attrs.Verbatim:
+		m := verbatimRegexp.FindSubmatch(content)
+		if m == nil && len(content) > 0 {
+			// the opening line was not recognized before the rendering, so the content has been rendered
+			return nil, &SyntaxError{c.pos, fmt.Sprintf("content of verbatim file %#v can't be extracted: the line must start with >>>", c.name)}
+		}
+		if m == nil {
+			return nil, nil
+		}
+		id, _ := strconv.Atoi(string(m[1]))
+		if id >= len(verbatim) {
+			return nil, fmt.Errorf("invalid verbatim marker in %#v", c.name)
+		}
+		return c.attrs.lineEndings(verbatim[id]), nil
+	case c.attrs.Binary:
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(content), nil)))
+		if err != nil {
+			return nil, &SyntaxError{c.pos, fmt.Sprintf("invalid base64 content of file %#v: %s", c.name, err)}
+		}
+		return decoded, nil
+	case c.attrs.Asset != "":
+		if len(bytes.TrimSpace(content)) > 0 {
+			return nil, &SyntaxError{c.pos, fmt.Sprintf("asset %#v must not have content", c.name)}
+		}
+		file := filepath.Join(g.AssetDir, filepath.FromSlash(c.attrs.Asset))
+		if err := g.checkAsset(file, c.pos); err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(file)
+	default:
+		return c.attrs.lineEndings(content), nil
+	}
+}
+
+// lineEndings converts the line endings of the content as defined by the eol and noeol attributes
+func (a Attributes) lineEndings(content []byte) []byte {
+	switch a.EOL {
+	case "lf":
+		content = bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+	case "crlf":
+		content = bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+		content = bytes.Replace(content, []byte("\n"), []byte("\r\n"), -1)
+	}
+
+	if a.NoEOL {
+		// a \r before the last \n only belongs to the line ending, if all lines end with \r\n
+		if a.EOL == "crlf" {
+			content = bytes.TrimSuffix(content, []byte("\r\n"))
+		} else {
+			content = bytes.TrimSuffix(content, []byte("\n"))
+		}
+	}
+	return content
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"gitlab.com/metakeule/config"
@@ -17,15 +21,30 @@ var (
 		`scaffold creates files and directories based on a template and json input.
 Complete documentation at https://pkg.go.dev/gitlab.com/metakeule/scaffold/lib/scaffold`)
 
-	templateArg     = cfg.NewString("template", "the file where the template resides", config.Default("scaffold.template"), config.Shortflag('t'))
+	templateArg     = cfg.NewString("template", "the file or directory (containing scaffold.head) where the template resides", config.Default("scaffold.template"), config.Shortflag('t'))
 	dirArg          = cfg.NewString("dir", "directory that is the target/root of the file creations", config.Default("."))
 	templatePathArg = cfg.NewString("path", "the path to look for template files, the different directories must be separated with a colon (:)")
 	verboseArg      = cfg.NewBool("verbose", "show verbose messages", config.Default(false), config.Shortflag('v'))
+	dataArg         = cfg.NewString("data", "files with the placeholders (instead of stdin), separated by colon (:) and merged in order. the input format is derived from the file extension, - is stdin")
+	inputFormatArg  = cfg.NewString("inputformat", "format of the placeholders: json, yaml, toml or env (default: json or derived from the data file extension)")
+	setArg          = cfg.NewString("set", "overrides placeholders, e.g. Models.0.Name=person, multiple overrides are separated by comma (,), \\, is a literal comma. values are strings unless they are true, false, null, numbers, quoted or json objects or arrays")
+	strictArg       = cfg.NewBool("strict", "fail if the template refers to a missing placeholder", config.Default(false))
+	skipEmptyArg    = cfg.NewBool("skipempty", "do not create files with empty content (or only whitespace)", config.Default(false))
+	unsafeArg       = cfg.NewBool("unsafe", "allow the template to write files outside of the target directory (only for trusted templates)", config.Default(false))
+	fileModeArg     = cfg.NewString("filemode", "permissions of created files as octal number, e.g. 0644 (default: 0664, the umask is applied)")
+	dirModeArg      = cfg.NewString("dirmode", "permissions of created directories as octal number, e.g. 0755 (default: 0770, the umask is applied)")
+	assetDirArg     = cfg.NewString("assetdir", "directory of the files referenced by asset contexts (default: the directory of the template)")
+	onConflictArg   = cfg.NewString("onconflict", "what to do with files that already exist: overwrite, fail, skip, backup, prompt or merge", config.Default("overwrite"))
 
 	headCmd    = cfg.MustCommand("head", "shows the head section of the given template").Skip("dir")
-	testCmd    = cfg.MustCommand("test", "makes a test run without creating any files")
+	testCmd    = cfg.MustCommand("test", "makes a test run without creating any files and shows what would be created, modified or left unchanged")
+	jsonArg    = testCmd.NewBool("json", "print the result of the test run as json", config.Default(false))
+	newCmd     = cfg.MustCommand("new", "asks for the placeholders as described by the head of the template and creates the files")
+	saveArg    = newCmd.NewString("save", "file where the answers are saved as json, to be reused as input")
+	lintCmd    = cfg.MustCommand("lint", "checks the template without any placeholders and exits with an error code if problems are found").Skip("dir")
 	scanCmd    = cfg.MustCommand("scan", "scan scans a directory and generates a template based on it. placeholders in dirs and files must start with #").Skip("template").Skip("dir")
 	scanDirArg = scanCmd.NewString("scandir", "directory which is scanned to create the template", config.Default("."))
+	assetsArg  = scanCmd.NewString("assets", "directory where binary files are copied to, instead of embedding them base64 encoded. pass it as --assetdir when running the template")
 
 	listCmd = cfg.MustCommand("list", "prints a list of template files, residing in path").Skip("template")
 )
@@ -33,7 +52,7 @@ Complete documentation at https://pkg.go.dev/gitlab.com/metakeule/scaffold/lib/s
 type notFound string
 
 func (n notFound) Error() string {
-	return fmt.Sprintf("could not find template file %#v", string(n))
+	return fmt.Sprintf("could not find template file (or directory with %s) %#v", scaffold.HeadFile, string(n))
 }
 
 func printTemplates() {
@@ -52,12 +71,17 @@ func printTemplates() {
 		} else {
 			var bf bytes.Buffer
 			for _, fi := range fileinfos {
-				if !fi.IsDir() {
-					name := fi.Name()
-					if name[0] != '.' {
-						bf.WriteString("  " + name + "\n")
-						// fmt.Fprintln(os.Stdout, name)
+				name := fi.Name()
+				if fi.IsDir() {
+					// only template directories
+					if !findInDir(path, name, true) {
+						continue
 					}
+					name += "/"
+				}
+				if name[0] != '.' {
+					bf.WriteString("  " + name + "\n")
+					// fmt.Fprintln(os.Stdout, name)
 				}
 			}
 
@@ -71,7 +95,9 @@ func printTemplates() {
 
 }
 
-func findInDir(path, file string) bool {
+// findInDir checks if the template file exists inside path. If dir is true, it checks for
+// a template directory instead, which must contain the scaffold.HeadFile.
+func findInDir(path, file string, dir bool) bool {
 	if verboseArg.Get() {
 		println("looking for ", filepath.Join(path, file))
 	}
@@ -83,25 +109,188 @@ func findInDir(path, file string) bool {
 	var info os.FileInfo
 	info, err = os.Stat(fullPath)
 
-	if err != nil {
+	if err != nil || info.IsDir() != dir {
 		return false
 	}
 
-	return !info.IsDir()
+	if dir {
+		_, err = os.Stat(filepath.Join(fullPath, scaffold.HeadFile))
+	}
+	return err == nil
+}
+
+// confirmOverwrite asks on the terminal if the given file should be overwritten.
+// Since stdin is used for the json input, the question is asked via /dev/tty.
+func confirmOverwrite(file string) (bool, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, fmt.Errorf("can't ask for overwriting %s: %s", file, err)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "%s already exists. overwrite? [y/N] ", file)
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// readStdin reads the placeholders from stdin
+func readStdin() (map[string]interface{}, error) {
+	format := inputFormatArg.Get()
+	if format == "" {
+		format = "json"
+	}
+	return scaffold.Decode(format, os.Stdin)
+}
+
+// parseHead sets the schema and the defaults that are declared by the head of the template.
+// Only the commands that generate files need them.
+func parseHead(g *scaffold.Generator, head string) (err error) {
+	g.Schema, err = scaffold.ParseSchema(head)
+	if err == nil {
+		g.Defaults, err = scaffold.HeadDefaults(head)
+	}
+	return err
+}
+
+// readData reads the placeholders from the data files or from stdin
+// and applies the overrides of the set option
+func readData() (data map[string]interface{}, err error) {
+	var layers []map[string]interface{}
+
+	if !dataArg.IsSet() {
+		data, err = readStdin()
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, data)
+	} else {
+		for _, file := range strings.Split(dataArg.Get(), ":") {
+			if file == "-" {
+				data, err = readStdin()
+			} else {
+				data, err = scaffold.DecodeFile(file, inputFormatArg.Get())
+			}
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, data)
+		}
+	}
+
+	data = scaffold.Merge(layers...)
+
+	if setArg.IsSet() {
+		for _, pair := range scaffold.SplitOverrides(setArg.Get()) {
+			idx := strings.Index(pair, "=")
+			if idx < 1 {
+				return nil, fmt.Errorf("invalid override %#v, should be key=value", pair)
+			}
+			err = scaffold.Set(data, pair[:idx], scaffold.ParseValue(pair[idx+1:]))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// printPlan prints the changes that g would make for the template to stdout
+func printPlan(g *scaffold.Generator, template string) error {
+	g.Log = nil
+	plan, err := g.Plan(template)
+	if err != nil {
+		return err
+	}
+	if !jsonArg.Get() {
+		fmt.Fprint(os.Stdout, plan.String())
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
+
+// lint prints the referenced fields and the problems of the template and exits
+func lint(g *scaffold.Generator, head, template string) {
+	fields, err := g.Lint(head, template)
+	for _, f := range fields {
+		fmt.Fprintln(os.Stdout, f)
+	}
+	if err == nil {
+		os.Exit(0)
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// assetDir returns the directory of the assets for the given template file
+func assetDir(templateFile string) string {
+	if assetDirArg.IsSet() {
+		return assetDirArg.Get()
+	}
+	return filepath.Dir(templateFile)
+}
+
+// parseMode parses the given octal permissions, an empty string is the default mode
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid mode %#v", s)
+	}
+	return os.FileMode(m), nil
 }
 
-// findFile finds the file inside the given path and returns the found file or an error
+// saveAnswers saves the answers of the new command as json
+func saveAnswers(file string, answers map[string]interface{}) error {
+	b, err := json.MarshalIndent(answers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(b, '\n'), 0644)
+}
+
+// readTemplate reads the template file or template directory and returns its head and body.
+// lineOffset is the number of lines of the template file that precede the body, sources
+// map the lines of the body of a template directory to its files.
+func readTemplate(file string) (head, body string, lineOffset int, sources scaffold.Sources, err error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", "", 0, nil, err
+	}
+	if info.IsDir() {
+		head, body, sources, err = scaffold.ReadTemplateDir(file)
+		return head, body, 0, sources, err
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", "", 0, nil, err
+	}
+	head, body = scaffold.SplitTemplate(string(raw))
+	return head, body, scaffold.BodyOffset(string(raw)), nil, nil
+}
+
+// findFile finds the file inside the given path and returns the found file or an error.
+// Template files are preferred to template directories in any of the paths.
 func findFile() (fullPath string, err error) {
 	paths := append([]string{""}, strings.Split(templatePathArg.Get(), ":")...)
 
 	file := templateArg.Get()
 
-	for _, p := range paths {
-		if findInDir(p, file) {
-			return filepath.Join(p, file), nil
-		}
-		if findInDir(p, file+".template") {
-			return filepath.Join(p, file+".template"), nil
+	for _, dir := range []bool{false, true} {
+		for _, p := range paths {
+			if findInDir(p, file, dir) {
+				return filepath.Join(p, file), nil
+			}
+			if findInDir(p, file+".template", dir) {
+				return filepath.Join(p, file+".template"), nil
+			}
 		}
 	}
 	return "", notFound(file)
@@ -110,12 +299,18 @@ func findFile() (fullPath string, err error) {
 func main() {
 
 	var (
-		err         error
-		dir         string
-		scanDir     string
-		file        string
-		templateRaw []byte
-		templ       []byte
+		err        error
+		dir        string
+		scanDir    string
+		file       string
+		head       string
+		template   string
+		lineOffset int
+		sources    scaffold.Sources
+		templ      []byte
+		onConflict scaffold.ConflictPolicy
+		fileMode   os.FileMode
+		dirMode    os.FileMode
 	)
 
 steps:
@@ -131,7 +326,11 @@ steps:
 			}
 		case 2:
 			if cfg.ActiveCommand() == scanCmd {
-				templ, err = scaffold.Scan(scanDir)
+				var opts []scaffold.ScanOption
+				if assetsArg.IsSet() {
+					opts = append(opts, scaffold.Assets(assetsArg.Get()))
+				}
+				templ, err = scaffold.Scan(scanDir, opts...)
 				if err == nil {
 					fmt.Fprintln(os.Stdout, string(templ))
 					os.Exit(0)
@@ -146,17 +345,64 @@ steps:
 		case 4:
 			dir, err = filepath.Abs(dirArg.Get())
 		case 5:
-			file, err = findFile()
+			onConflict, err = scaffold.ParseConflictPolicy(onConflictArg.Get())
+			if err == nil {
+				fileMode, err = parseMode(fileModeArg.Get())
+			}
+			if err == nil {
+				dirMode, err = parseMode(dirModeArg.Get())
+			}
 		case 6:
-			println("found ", file)
-			templateRaw, err = ioutil.ReadFile(file)
+			file, err = findFile()
 		case 7:
-			head, template := scaffold.SplitTemplate(string(templateRaw))
+			println("found ", file)
+			head, template, lineOffset, sources, err = readTemplate(file)
+		case 8:
+			g := &scaffold.Generator{
+				BaseDir:    dir,
+				OnConflict: onConflict,
+				Confirm:    confirmOverwrite,
+				Log:        os.Stdout,
+				Strict:     strictArg.Get(),
+				Unsafe:     unsafeArg.Get(),
+				SkipEmpty:  skipEmptyArg.Get(),
+				FileMode:   fileMode,
+				DirMode:    dirMode,
+				Name:       file,
+				LineOffset: lineOffset,
+				Sources:    sources,
+				AssetDir:   assetDir(file),
+			}
 			switch cfg.ActiveCommand() {
 			case nil:
-				err = scaffold.Run(dir, template, os.Stdin, os.Stdout, false)
+				err = parseHead(g, head)
+				if err == nil {
+					g.Data, err = readData()
+				}
+				if err == nil {
+					err = g.Run(template)
+				}
 			case testCmd:
-				err = scaffold.Run(dir, template, os.Stdin, os.Stdout, true)
+				err = parseHead(g, head)
+				if err == nil {
+					g.Data, err = readData()
+				}
+				if err == nil {
+					err = printPlan(g, template)
+				}
+			case newCmd:
+				err = parseHead(g, head)
+				if err == nil {
+					g.Data, err = scaffold.Prompt(head, os.Stdin, os.Stdout)
+				}
+				if err == nil && saveArg.IsSet() {
+					err = saveAnswers(saveArg.Get(), g.Data)
+				}
+				if err == nil {
+					err = g.Run(template)
+				}
+			case lintCmd:
+				lint(g, head, template)
 			case headCmd:
 				fmt.Fprintln(os.Stdout, head)
 			default: